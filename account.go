@@ -0,0 +1,174 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// accountMarker is the comment of the accounts created by the library, so Remove never deletes other accounts.
+// The group is only deleted if it was created together with the user, which is recorded by accountGroupMarker.
+const (
+	accountMarker      = "created by daemon for "
+	accountGroupMarker = " with its group"
+)
+
+// nologinShells are tried in order to find the shell of the created accounts
+var nologinShells = []string{"/usr/sbin/nologin", "/sbin/nologin", "/bin/false"}
+
+// UserSpec describes how the service's user and group are created by Install if they don't exist
+type UserSpec struct {
+	System  bool   `json:"system" yaml:"system" toml:"system"`    // create a system account and group
+	Home    string `json:"home" yaml:"home" toml:"home"`          // the home directory which is created with the account, no home directory if it's empty
+	Shell   string `json:"shell" yaml:"shell" toml:"shell"`       // the login shell, a nologin shell if it's empty
+	Delete  bool   `json:"delete" yaml:"delete" toml:"delete"`    // delete the user and group on Remove if they have been created by Install
+	Dynamic bool   `json:"dynamic" yaml:"dynamic" toml:"dynamic"` // use DynamicUser= on systemd instead of creating the account, the other backends still create it
+}
+
+// WithCreateUser creates the user and group set by WithUser and WithGroup on Install if they are missing,
+// useradd and groupadd are used if they exist, otherwise adduser and addgroup of busybox
+func WithCreateUser(spec UserSpec) Configurator {
+	return Option(func(c *config) {
+		c.CreateUser = &spec
+	})
+}
+
+// dynamicUser reports whether systemd allocates the user when the service starts
+func (c *config) dynamicUser() bool {
+	return c.CreateUser != nil && c.CreateUser.Dynamic
+}
+
+// createAccount creates the missing user and group of the service
+func createAccount(c *config) error {
+	spec := c.CreateUser
+	if spec == nil {
+		return nil
+	}
+	_, userErr := user.Lookup(c.User)
+	_, groupErr := user.LookupGroup(c.Group)
+	if userErr == nil && groupErr == nil {
+		return nil
+	}
+	busybox := !commandExists("useradd")
+
+	comment := accountMarker + c.Name
+	if groupErr != nil {
+		var args []string
+		if busybox {
+			args = []string{"addgroup"}
+			if spec.System {
+				args = append(args, "-S")
+			}
+		} else {
+			args = []string{"groupadd"}
+			if spec.System {
+				args = append(args, "--system")
+			}
+		}
+		if err := runAccountCommand(append(args, c.Group)...); err != nil {
+			return err
+		}
+		comment += accountGroupMarker
+	}
+	if userErr == nil {
+		return nil
+	}
+
+	shell := spec.Shell
+	if shell == "" {
+		shell = nologinShell()
+	}
+	var args []string
+	if busybox {
+		args = []string{"adduser", "-D", "-G", c.Group, "-s", shell, "-g", comment}
+		if spec.System {
+			args = append(args, "-S")
+		}
+		if spec.Home != "" {
+			args = append(args, "-h", spec.Home)
+		} else {
+			args = append(args, "-H")
+		}
+	} else {
+		args = []string{"useradd", "-g", c.Group, "-s", shell, "-c", comment}
+		if spec.System {
+			args = append(args, "--system")
+		}
+		if spec.Home != "" {
+			args = append(args, "-m", "-d", spec.Home)
+		} else {
+			args = append(args, "-M")
+		}
+	}
+	return runAccountCommand(append(args, c.User)...)
+}
+
+// deleteAccount deletes the user and group if they have been created for the service and UserSpec.Delete is set
+func deleteAccount(c *config) error {
+	if c.CreateUser == nil || !c.CreateUser.Delete {
+		return nil
+	}
+	comment, err := accountComment(c.User)
+	if err != nil || !strings.HasPrefix(comment, accountMarker+c.Name) {
+		return nil
+	}
+	busybox := !commandExists("userdel")
+	if busybox {
+		err = runAccountCommand("deluser", c.User)
+	} else {
+		err = runAccountCommand("userdel", c.User)
+	}
+	if err != nil || !strings.HasSuffix(comment, accountGroupMarker) {
+		return err
+	}
+	if _, err = user.LookupGroup(c.Group); err != nil {
+		// busybox deletes the group with the user if it's empty
+		return nil
+	}
+	if busybox {
+		return runAccountCommand("delgroup", c.Group)
+	}
+	return runAccountCommand("groupdel", c.Group)
+}
+
+// accountComment returns the comment field of the user in /etc/passwd
+func accountComment(name string) (string, error) {
+	file, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 4 && fields[0] == name {
+			return fields[4], nil
+		}
+	}
+	return "", user.UnknownUserError(name)
+}
+
+func runAccountCommand(args ...string) error {
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func nologinShell() string {
+	for _, shell := range nologinShells {
+		if pathOrFileIsExist(shell) {
+			return shell
+		}
+	}
+	return nologinShells[len(nologinShells)-1]
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
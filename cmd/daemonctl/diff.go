@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines printed around a change
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines computes a line based edit script from a to b by the longest common subsequence,
+// the service files are small enough for the quadratic algorithm
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// writeDiff prints the difference between the installed and the rendered content,
+// it returns false if they are the same
+func writeDiff(w io.Writer, path string, installed, rendered []byte) bool {
+	ops := diffLines(splitLines(string(installed)), splitLines(string(rendered)))
+	changed := false
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	fmt.Fprintf(w, "--- %s (installed)\n+++ %s (rendered)\n", path, path)
+	lastPrinted := -1
+	for k, op := range ops {
+		if op.kind == ' ' && !nearChange(ops, k) {
+			continue
+		}
+		if lastPrinted >= 0 && k > lastPrinted+1 {
+			fmt.Fprintln(w, "@@")
+		}
+		fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		lastPrinted = k
+	}
+	return true
+}
+
+func nearChange(ops []diffOp, k int) bool {
+	for d := -diffContext; d <= diffContext; d++ {
+		if n := k + d; n >= 0 && n < len(ops) && ops[n].kind != ' ' {
+			return true
+		}
+	}
+	return false
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
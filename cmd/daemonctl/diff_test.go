@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// script formats the edit script like the diff prints it
+func script(ops []diffOp) []string {
+	lines := make([]string, 0, len(ops))
+	for _, op := range ops {
+		lines = append(lines, string(op.kind)+op.line)
+	}
+	return lines
+}
+
+func TestDiffLines(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		a, b string
+		want []string
+	}{
+		{"identical", "a\nb\nc", "a\nb\nc", []string{" a", " b", " c"}},
+		{"both empty", "", "", []string{}},
+		{"insert", "a\nc", "a\nb\nc", []string{" a", "+b", " c"}},
+		{"insert at the end", "a", "a\nb", []string{" a", "+b"}},
+		{"insert into empty", "", "a\nb", []string{"+a", "+b"}},
+		{"delete", "a\nb\nc", "a\nc", []string{" a", "-b", " c"}},
+		{"delete at the start", "a\nb", "b", []string{"-a", " b"}},
+		{"delete all", "a\nb", "", []string{"-a", "-b"}},
+		{"change", "a\nb\nc", "a\nx\nc", []string{" a", "-b", "+x", " c"}},
+		{"change all", "a\nb", "x\ny", []string{"-a", "-b", "+x", "+y"}},
+		{"move", "a\nb\nc", "b\nc\na", []string{"-a", " b", " c", "+a"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := script(diffLines(splitLines(tt.a), splitLines(tt.b)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	numbered := func(change map[int]string) []byte {
+		var b strings.Builder
+		for i := 1; i <= 12; i++ {
+			if line, ok := change[i]; ok {
+				b.WriteString(line + "\n")
+				continue
+			}
+			b.WriteString(strings.Repeat("x", i) + "\n")
+		}
+		return []byte(b.String())
+	}
+	installed := numbered(nil)
+
+	for _, tt := range []struct {
+		name     string
+		rendered []byte
+		want     string
+	}{
+		{"identical", installed, ""},
+		{
+			"one change with context",
+			numbered(map[int]string{6: "six"}),
+			"--- /etc/svc (installed)\n+++ /etc/svc (rendered)\n" +
+				" xxx\n xxxx\n xxxxx\n-xxxxxx\n+six\n xxxxxxx\n xxxxxxxx\n xxxxxxxxx\n",
+		},
+		{
+			"distant changes are separated",
+			numbered(map[int]string{1: "one", 12: "twelve"}),
+			"--- /etc/svc (installed)\n+++ /etc/svc (rendered)\n" +
+				"-x\n+one\n xx\n xxx\n xxxx\n@@\n xxxxxxxxx\n xxxxxxxxxx\n xxxxxxxxxxx\n-xxxxxxxxxxxx\n+twelve\n",
+		},
+		{
+			"the missing trailing newline doesn't count",
+			[]byte(strings.TrimSuffix(string(installed), "\n")),
+			"",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			changed := writeDiff(&out, "/etc/svc", installed, tt.rendered)
+			if changed != (tt.want != "") {
+				t.Errorf("writeDiff changed = %v, want %v", changed, tt.want != "")
+			}
+			if out.String() != tt.want {
+				t.Errorf("writeDiff printed\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Command daemonctl manages services described by spec files with the daemon package,
+// it allows wrapping third party binaries without writing any Go code.
+//
+// A spec is a JSON, YAML or TOML file loaded by daemon.FromFile, its fields match the daemon.With* options:
+//
+//	name: wrapother
+//	exec: /home/shgsec/wrapother
+//	args: --port 8080
+//	user: shgsec
+//	group: shgsec
+//	log_file: /home/shgsec/wrapother.log
+//
+// Usage:
+//
+//	daemonctl -f wrapother.yaml install
+//	daemonctl -d /etc/daemonctl.d status
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jiashaoying/daemon"
+)
+
+// privilegedCommands change the system, daemonctl escalates the privileges once for all the specs
+// with its own arguments, daemon.Main would re-execute it without -f or -d
+var privilegedCommands = map[string]bool{
+	"install": true,
+	"enable":  true,
+	"disable": true,
+	"remove":  true,
+	"start":   true,
+	"stop":    true,
+	"restart": true,
+	"upgrade": true,
+	"monitor": true,
+}
+
+// exitNoPrivileges is the LSB exit code of daemon.Main for the missing privileges
+const exitNoPrivileges = 4
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	fs := flag.NewFlagSet("daemonctl", flag.ContinueOnError)
+	file := fs.String("f", "", "the service spec file")
+	dir := fs.String("d", "", "the directory of service spec files for bulk operations")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: daemonctl [-f spec | -d dir] <command> [flags] [args]")
+		fmt.Fprintln(fs.Output(), "\nRun 'daemonctl -f spec help' to list the commands.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if (*file == "") == (*dir == "") || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	specs := []string{*file}
+	if *dir != "" {
+		var err error
+		if specs, err = listSpecs(*dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// these commands run until interrupted, so the services after the first one would never be reached
+		switch fs.Arg(0) {
+		case "log", "monitor", "watch":
+			fmt.Fprintf(os.Stderr, "%s can't be used with multiple services, use -f instead\n", fs.Arg(0))
+			return 2
+		}
+	}
+
+	if privilegedCommands[fs.Arg(0)] {
+		code, escalated, err := escalate(specs, args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitNoPrivileges
+		}
+		if escalated {
+			return code
+		}
+	}
+
+	code := 0
+	for _, path := range specs {
+		if len(specs) > 1 {
+			fmt.Printf("==> %s <==\n", specTitle(path))
+		}
+		if c := runSpec(path, fs.Args()); c > code {
+			code = c
+		}
+	}
+	return code
+}
+
+func runSpec(path string, args []string) int {
+	d, err := loadSpec(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	return daemon.Main(d, append([]string{"daemonctl"}, args...), renderCommand(), diffCommand())
+}
+
+// escalate escalates the privileges as configured by the first valid spec, the invalid ones are reported by runSpec
+func escalate(specs, args []string) (int, bool, error) {
+	for _, path := range specs {
+		if d, err := loadSpec(path); err == nil {
+			return daemon.Escalate(d, args)
+		}
+	}
+	return 0, false, nil
+}
+
+// render renders the service files of the daemons which implement daemon.Renderer
+func render(d daemon.Daemon) ([]daemon.Artifact, error) {
+	r, ok := d.(daemon.Renderer)
+	if !ok {
+		return nil, daemon.Exit(3, errors.New("the service files can't be rendered"))
+	}
+	return r.Render()
+}
+
+func renderCommand() daemon.Command {
+	return daemon.Command{
+		Name:  "render",
+		Usage: "print the service files which would be written by install",
+		Run: func(d daemon.Daemon, args []string) error {
+			files, err := render(d)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				fmt.Printf("# %s (%s)\n%s\n", f.Path, f.Mode, f.Content)
+			}
+			return nil
+		},
+	}
+}
+
+func diffCommand() daemon.Command {
+	return daemon.Command{
+		Name:  "diff",
+		Usage: "compare the installed service files with the rendered ones, exits with 1 if they differ",
+		Run: func(d daemon.Daemon, args []string) error {
+			files, err := render(d)
+			if err != nil {
+				return err
+			}
+			differ := false
+			for _, f := range files {
+				installed, exist, err := readFileOrEmpty(f.Path)
+				if err != nil {
+					return err
+				}
+				if !exist {
+					fmt.Printf("%s is not installed\n", f.Path)
+					differ = true
+					continue
+				}
+				if writeDiff(os.Stdout, f.Path, installed, f.Content) {
+					differ = true
+				}
+			}
+			if differ {
+				return daemon.Exit(1, nil)
+			}
+			return nil
+		},
+	}
+}
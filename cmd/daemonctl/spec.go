@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jiashaoying/daemon"
+)
+
+// specExtensions are the file extensions recognized as service specs
+var specExtensions = map[string]bool{".json": true, ".yaml": true, ".yml": true, ".toml": true}
+
+// listSpecs returns the spec files in dir sorted by file name
+func listSpecs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() || !specExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no service spec found", dir)
+	}
+	return paths, nil
+}
+
+// loadSpec creates the daemon described by the spec file
+func loadSpec(path string) (daemon.Daemon, error) {
+	// the default executable is daemonctl itself, so the spec must specify it
+	return daemon.New(daemon.WithExec(""), daemon.FromFile(path))
+}
+
+// specTitle is used to tell the services apart in bulk operations
+func specTitle(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+func readFileOrEmpty(path string) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return data, true, nil
+}
@@ -0,0 +1,406 @@
+package daemon
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exit codes follow the LSB init script actions
+// see https://refspecs.linuxfoundation.org/LSB_3.1.1/LSB-Core-generic/LSB-Core-generic/iniscrptact.html
+const (
+	exitOK            = 0
+	exitFailure       = 1
+	exitUsage         = 2
+	exitUnimplemented = 3
+	exitNoPrivileges  = 4
+	exitNotInstalled  = 5
+	exitStatusStopped = 3
+	exitStatusUnknown = 4
+)
+
+const (
+	helpCommand        = "help"
+	commandUsageIndent = "  "
+)
+
+// Command is a sub command which can be dispatched by Main
+type Command struct {
+	Name  string // the word typed on the command line, e.g. "install"
+	Usage string // one line description shown in the help message
+	// Flags is parsed before Run is called, it may be nil if the command has no flags
+	Flags *flag.FlagSet
+	// Privileged makes Main check the privileges before Run, and escalate them as configured by WithEscalation
+	Privileged bool
+	// Run executes the command with the remaining arguments after the flags have been parsed,
+	// the returned error is converted into an exit code by Main
+	Run func(d Daemon, args []string) error
+}
+
+// exitError carries an explicit exit code out of a Command's Run
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// Exit returns an error which makes Main exit with the given code,
+// err may be nil if there is nothing to print
+func Exit(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// stateReporter is implemented by all the built-in backends
+type stateReporter interface {
+	isInstalled() bool
+	isRunning() bool
+}
+
+// Main parses args (normally os.Args) and runs the matched command against d,
+// it returns the exit code which should be passed to os.Exit.
+// The privileges are escalated by re-executing the binary with args, so args[1:] must run the command again.
+// The built-in commands are install, enable, disable, remove, start, stop, restart, status, log, upgrade, monitor and watch,
+// commands can be used to add new commands or to replace the built-in ones.
+func Main(d Daemon, args []string, commands ...Command) int {
+	prog := "daemon"
+	if len(args) > 0 {
+		prog = filepath.Base(args[0])
+		args = args[1:]
+	}
+
+	table := make(map[string]Command)
+	for _, cmd := range builtinCommands() {
+		table[cmd.Name] = cmd
+	}
+	for _, cmd := range commands {
+		table[cmd.Name] = cmd
+	}
+
+	if len(args) == 0 {
+		printUsage(os.Stderr, prog, table)
+		return exitUsage
+	}
+
+	// the escalated binary runs the same command
+	dispatched := args
+	name := args[0]
+	args = args[1:]
+	if name == helpCommand || name == "-h" || name == "--help" {
+		if len(args) > 0 {
+			if cmd, ok := table[args[0]]; ok {
+				printCommandUsage(os.Stdout, prog, cmd)
+				return exitOK
+			}
+		}
+		printUsage(os.Stdout, prog, table)
+		return exitOK
+	}
+
+	cmd, ok := table[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		printUsage(os.Stderr, prog, table)
+		return exitUsage
+	}
+
+	flags := cmd.Flags
+	if flags == nil {
+		flags = flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	}
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printCommandUsage(os.Stdout, prog, cmd)
+			return exitOK
+		}
+		fmt.Fprintln(os.Stderr, err)
+		printCommandUsage(os.Stderr, prog, cmd)
+		return exitUsage
+	}
+
+	if d == nil {
+		fmt.Fprintln(os.Stderr, errUnsupportedSystem)
+		return exitUnimplemented
+	}
+	if cmd.Privileged {
+		code, escalated, err := Escalate(d, dispatched)
+		if err != nil {
+			return exitCode(err)
+		}
+		if escalated {
+			return code
+		}
+	}
+	return exitCode(cmd.Run(d, flags.Args()))
+}
+
+func builtinCommands() []Command {
+	action := func(name, usage, done string, run func(d Daemon) error) Command {
+		return Command{
+			Name:       name,
+			Usage:      usage,
+			Privileged: true,
+			Run: func(d Daemon, args []string) error {
+				if err := run(d); err != nil {
+					return err
+				}
+				fmt.Println(done)
+				return nil
+			},
+		}
+	}
+	return []Command{
+		action("install", "install the service and enable it at boot", "Succeeded", func(d Daemon) error { return d.Install() }),
+		action("enable", "start the service at boot", "Succeeded", func(d Daemon) error { return d.Enable() }),
+		action("disable", "don't start the service at boot", "Succeeded", func(d Daemon) error { return d.Disable() }),
+		removeCommand(),
+		action("start", "start the service", "Succeeded", func(d Daemon) error {
+			if err := d.Start(); err != nil {
+				// starting a running service is considered successful by LSB
+				if errors.Is(err, errAlreadyRunning) {
+					return Exit(exitOK, err)
+				}
+				return err
+			}
+			return nil
+		}),
+		action("stop", "stop the service", "Succeeded", func(d Daemon) error {
+			if err := d.Stop(); err != nil {
+				// stopping a stopped service is considered successful by LSB
+				if errors.Is(err, errAlreadyStopped) {
+					return Exit(exitOK, err)
+				}
+				return err
+			}
+			return nil
+		}),
+		action("restart", "stop the service if it is running and start it again", "Succeeded", restart),
+		{
+			Name:  "status",
+			Usage: "print the status of the service, exits with 0 if it is running, 3 if it has stopped",
+			Run:   runStatus,
+		},
+		logCommand(),
+		upgradeCommand(),
+		{
+			Name:       "monitor",
+			Usage:      "check the health of the service until interrupted and restart it after consecutive failures",
+			Privileged: true,
+			Run: func(d Daemon, args []string) error {
+				ctx, cancel := interruptContext()
+				defer cancel()
+				return Monitor(ctx, d)
+			},
+		},
+		{
+			Name:  "watch",
+			Usage: "print the state changes of the service until interrupted",
+			Run: func(d Daemon, args []string) error {
+				ctx, cancel := interruptContext()
+				defer cancel()
+				w, ok := d.(Watcher)
+				if !ok {
+					return errUnsupportedOperation
+				}
+				events, err := w.Watch(ctx)
+				if err != nil {
+					return err
+				}
+				for event := range events {
+					printStateEvent(event)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func printStateEvent(event StateEvent) {
+	line := event.Time.Format(time.RFC3339) + " " + event.Unit + " " + string(event.State)
+	if (event.State == Exited || event.State == Restarting) && event.ExitCode >= 0 {
+		line += fmt.Sprintf(" (exit code %d)", event.ExitCode)
+	}
+	fmt.Println(line)
+}
+
+func removeCommand() Command {
+	flags := flag.NewFlagSet("remove", flag.ContinueOnError)
+	purge := flags.Bool("purge", false, "delete the managed directories created by install as well")
+	return Command{
+		Name:       "remove",
+		Usage:      "stop and uninstall the service",
+		Flags:      flags,
+		Privileged: true,
+		Run: func(d Daemon, args []string) error {
+			if err := removeWith(d, RemoveOptions{Purge: *purge}); err != nil {
+				return err
+			}
+			fmt.Println("Succeeded")
+			return nil
+		},
+	}
+}
+
+func upgradeCommand() Command {
+	flags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	selfTest := flags.Bool("self-test", false, "run the new executable with --self-test before the upgrade")
+	wait := flags.Duration("wait", defaultUpgradeWait, "how long the restarted service must keep running")
+	return Command{
+		Name:       "upgrade",
+		Usage:      "replace the executable with a new one and restart the service, roll back if it fails",
+		Flags:      flags,
+		Privileged: true,
+		Run: func(d Daemon, args []string) error {
+			if len(args) != 1 {
+				return Exit(exitUsage, errors.New("expect the path of the new executable"))
+			}
+			u, ok := d.(Upgrader)
+			if !ok {
+				return errUnsupportedOperation
+			}
+			if err := u.Upgrade(args[0], UpgradeOptions{SelfTest: *selfTest, Wait: *wait}); err != nil {
+				return err
+			}
+			fmt.Println("Succeeded")
+			return nil
+		},
+	}
+}
+
+func logCommand() Command {
+	flags := flag.NewFlagSet("log", flag.ContinueOnError)
+	lines := flags.Int("n", defaultLogLines, "the number of last lines to show, 0 shows all")
+	noFollow := flags.Bool("no-follow", false, "exit after showing the lines instead of following new ones")
+	since := flags.String("since", "", "show the lines logged after the time, e.g. \"2006-01-02 15:04:05\" or 1h for an hour ago")
+	until := flags.String("until", "", "show the lines logged before the time, in the same format as -since")
+	stderr := flags.Bool("stderr", false, "show the stderr log, which is only separated from stdout by WithStderrLogFile")
+	return Command{
+		Name:  "log",
+		Usage: "show and follow the log of the service",
+		Flags: flags,
+		Run: func(d Daemon, args []string) error {
+			r, ok := d.(LogReader)
+			if !ok {
+				// Log shows the default lines, it can't honour the flags
+				if flags.NFlag() > 0 {
+					return errUnsupportedOperation
+				}
+				return d.Log()
+			}
+			opts := LogOptions{Follow: !*noFollow, Lines: *lines, Writer: os.Stdout}
+			if *stderr {
+				opts.Stream = Stderr
+			}
+			var err error
+			if opts.Since, err = parseLogTime(*since); err != nil {
+				return Exit(exitUsage, err)
+			}
+			if opts.Until, err = parseLogTime(*until); err != nil {
+				return Exit(exitUsage, err)
+			}
+			ctx, cancel := interruptContext()
+			defer cancel()
+			return r.Logs(ctx, opts)
+		},
+	}
+}
+
+// parseLogTime parses an absolute time or a duration before now, the empty string is the zero time
+func parseLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, journalTimeLayout, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+func runStatus(d Daemon, args []string) error {
+	if err := d.Status(); err != nil {
+		// not installed or not readable, LSB treats both as unknown status
+		return Exit(exitStatusUnknown, err)
+	}
+	if sr, ok := d.(stateReporter); ok && !sr.isRunning() {
+		return Exit(exitStatusStopped, nil)
+	}
+	return nil
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	code := exitFailure
+	var ee *exitError
+	switch {
+	case errors.As(err, &ee):
+		code = ee.code
+	case errors.Is(err, errRootPrivileges):
+		code = exitNoPrivileges
+	case errors.Is(err, errNotInstalled):
+		code = exitNotInstalled
+	case errors.Is(err, errUnsupportedSystem), errors.Is(err, errUnsupportedOperation):
+		code = exitUnimplemented
+	}
+	if ee == nil || ee.err != nil {
+		if code == exitOK {
+			fmt.Fprintln(os.Stdout, err)
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return code
+}
+
+func printUsage(w io.Writer, prog string, table map[string]Command) {
+	names := make([]string, 0, len(table))
+	width := len(helpCommand)
+	for name := range table {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [args]\n\nCommands:\n", prog)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%-*s  %s\n", commandUsageIndent, width, name, table[name].Usage)
+	}
+	fmt.Fprintf(w, "%s%-*s  %s\n", commandUsageIndent, width, helpCommand, "show the help of a command")
+}
+
+func printCommandUsage(w io.Writer, prog string, cmd Command) {
+	fmt.Fprintf(w, "Usage: %s %s [flags] [args]\n\n%s%s\n", prog, cmd.Name, commandUsageIndent, cmd.Usage)
+	if cmd.Flags == nil {
+		return
+	}
+	var b strings.Builder
+	cmd.Flags.SetOutput(&b)
+	cmd.Flags.PrintDefaults()
+	if b.Len() > 0 {
+		fmt.Fprintf(w, "\nFlags:\n%s", b.String())
+	}
+}
@@ -0,0 +1,254 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// cronJob runs a scheduled job by cron on the systemv hosts, which have no timers
+type cronJob struct {
+	c *config
+}
+
+func (j *cronJob) Install() (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("failed to install job: %w", err)
+		}
+	}()
+	if err = checkPrivileges(); err != nil {
+		return err
+	}
+	if j.isInstalled() {
+		return errAlreadyInstalled
+	}
+	if j.c.Exec, err = executablePath(j.c.Exec); err != nil {
+		return err
+	}
+	if err = createAccount(j.c); err != nil {
+		return err
+	}
+
+	files, err := j.render(j.c)
+	if err != nil {
+		return err
+	}
+	if err = writeFiles(files); err != nil {
+		return err
+	}
+	// clean up the job files if an error occurs in the next operation
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				_ = os.Remove(f.Path)
+			}
+		}
+	}()
+
+	if err = prepareLogFile(j.c); err != nil {
+		return err
+	}
+	if err = createDirs(j.c, false); err != nil {
+		return err
+	}
+	return j.c.runOnInstall()
+}
+
+// Enable and Disable have nothing to do, cron runs the job once it's installed
+func (j *cronJob) Enable() error {
+	return nil
+}
+
+func (j *cronJob) Disable() error {
+	return nil
+}
+
+func (j *cronJob) Remove() error {
+	return j.RemoveWith(RemoveOptions{})
+}
+
+// RemoveWith uninstalls the job, and deletes the managed directories created by Install if opts.Purge is set
+func (j *cronJob) RemoveWith(opts RemoveOptions) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("failed to remove job: %w", err)
+		}
+	}()
+	if err = checkPrivileges(); err != nil {
+		return err
+	}
+	if !j.isInstalled() {
+		return errNotInstalled
+	}
+	if err = os.Remove(j.servicePath()); err != nil {
+		return err
+	}
+	if err = removeLogRotate(j.c.Name); err != nil {
+		return err
+	}
+	if err = removeDirs(j.c, opts.Purge); err != nil {
+		return err
+	}
+	if err = deleteAccount(j.c); err != nil {
+		return err
+	}
+	return j.c.runOnRemove()
+}
+
+func (j *cronJob) Start() error {
+	return errScheduled
+}
+
+func (j *cronJob) Stop() error {
+	return errScheduled
+}
+
+func (j *cronJob) Restart() error {
+	return errScheduled
+}
+
+func (j *cronJob) Status() error {
+	if !j.isInstalled() {
+		return errNotInstalled
+	}
+	fields, err := cronSchedule(j.c.Schedule)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Job is scheduled by cron: " + fields)
+	return nil
+}
+
+func (j *cronJob) Log() error {
+	if !j.isInstalled() {
+		return errNotInstalled
+	}
+	fmt.Println("==> Press Ctrl-C to exit <==")
+	return followLog(j.Logs)
+}
+
+func (j *cronJob) Logs(ctx context.Context, opts LogOptions) error {
+	if !j.isInstalled() {
+		return errNotInstalled
+	}
+	if opts.Stream == Stderr || j.c.LogOutput.kind == fileOutput {
+		return fileLogs(ctx, j.c, opts)
+	}
+	if j.c.LogOutput.kind == nullOutput {
+		return errLogNotReadable
+	}
+	return syslogLogs(ctx, j.c, opts)
+}
+
+func (j *cronJob) LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error) {
+	if !j.isInstalled() {
+		return nil, errNotInstalled
+	}
+	if opts.Stream == Stderr || j.c.LogOutput.kind == fileOutput {
+		return fileEntries(ctx, j.c, opts, j.Logs)
+	}
+	if j.c.LogOutput.kind == nullOutput {
+		return nil, errLogNotReadable
+	}
+	return syslogEntries(ctx, j.c, opts)
+}
+
+// Upgrade replaces the executable, which the next run of the job uses
+func (j *cronJob) Upgrade(newExec string, opts ...UpgradeOptions) error {
+	if err := checkPrivileges(); err != nil {
+		return err
+	}
+	if !j.isInstalled() {
+		return errNotInstalled
+	}
+	return upgradeExec(j.c, newExec, opts, j.isRunning, j.Restart)
+}
+
+func (j *cronJob) Health(ctx context.Context) error {
+	if !j.isInstalled() {
+		return errNotInstalled
+	}
+	return checkHealth(ctx, j.c)
+}
+
+func (j *cronJob) Watch(ctx context.Context) (<-chan StateEvent, error) {
+	if !j.isInstalled() {
+		return nil, errNotInstalled
+	}
+	return nil, errWatchUnsupported
+}
+
+func (j *cronJob) Render() ([]Artifact, error) {
+	return j.render(renderConfig(j.c))
+}
+
+func (j *cronJob) render(c *config) ([]Artifact, error) {
+	fields, err := cronSchedule(c.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	line, err := cronCommand(c)
+	if err != nil {
+		return nil, err
+	}
+	content, err := renderTemplate("cronJob", cronJobTemplate, struct {
+		Name, Fields, User, Command string
+	}{c.Name, fields, c.User, line})
+	if err != nil {
+		return nil, err
+	}
+	files := []Artifact{{Path: j.servicePath(), Mode: 0644, Content: content}}
+	return renderLogRotateFor(c, files, true)
+}
+
+// cronCommand renders the command of the crontab line with the output redirected to the log output,
+// % ends the command in a crontab line, so it's escaped
+func cronCommand(c *config) (string, error) {
+	line, err := shellCommandLine(c)
+	if err != nil {
+		return "", err
+	}
+	stderr := "2>&1"
+	if c.StderrLogFile != "" {
+		stderr = "2>> " + shellQuote(c.StderrLogFile)
+	}
+	switch c.LogOutput.kind {
+	case fileOutput:
+		line = "{ " + line + "; } >> " + shellQuote(c.LogFile) + " " + stderr
+	case nullOutput:
+		line = "{ " + line + "; } > /dev/null " + stderr
+	default:
+		facility, err := logFacility(c.LogOutput)
+		if err != nil {
+			return "", err
+		}
+		line = "{ " + line + "; } " + stderr + " | logger -t " + shellQuote(c.Name) + " -p " + facility + ".info"
+	}
+	return strings.Replace(line, "%", `\%`, -1), nil
+}
+
+func (j *cronJob) servicePath() string {
+	return "/etc/cron.d/" + j.c.Name
+}
+
+func (j *cronJob) isInstalled() bool {
+	return pathOrFileIsExist(j.servicePath())
+}
+
+// isRunning is false, a job only runs for a while
+func (j *cronJob) isRunning() bool {
+	return false
+}
+
+// instance is never called, scheduled jobs have no instances
+func (j *cronJob) instance(name string) (Daemon, error) {
+	return nil, errNoInstances
+}
+
+var cronJobTemplate = `# {{commentValue .Name}} is run on schedule, written by daemon
+SHELL=/bin/sh
+PATH=/usr/local/sbin:/usr/local/bin:/sbin:/bin:/usr/sbin:/usr/bin
+{{.Fields}} {{safeName .User}} {{.Command}}
+`
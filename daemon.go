@@ -1,25 +1,23 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
-	"strings"
-	"syscall"
+	"text/template"
 )
 
 var (
 	// errUnsupportedSystem appears if try to use service on system which is not supported by this release
 	errUnsupportedSystem = errors.New("unsupported system")
 
-	// errRootPrivileges appears if run installation or deleting the service without root privileges
+	// errRootPrivileges appears if an operation which changes the system runs without root privileges or the equivalent capabilities
 	errRootPrivileges = errors.New("you must have root user privileges. possibly using 'sudo' command should help")
 
 	// ErrAlreadyInstalled appears if service already installed on the system
@@ -39,6 +37,15 @@ var (
 
 	// errConfigIsNil appears if the Config is nil when call New method
 	errConfigIsNil = errors.New("the config can't be nil")
+
+	// errNonInteractiveEscalation appears if the privileges can't be escalated without a terminal to ask for the password
+	errNonInteractiveEscalation = errors.New("refuse to escalate privileges in a non-interactive session")
+
+	// errUnknownConfigFormat appears if the config file is not a JSON, YAML or TOML file
+	errUnknownConfigFormat = errors.New("unknown config format, expect .json, .yaml, .yml or .toml")
+
+	// errUnsupportedOperation appears if the daemon doesn't implement an optional operation such as LogEntryReader
+	errUnsupportedOperation = errors.New("the operation is not supported by the daemon")
 )
 
 const (
@@ -61,28 +68,97 @@ type Daemon interface {
 	Log() error
 }
 
+// Restarter is implemented by the daemons which can restart the service in one operation,
+// all the built-in backends do. The other daemons are restarted by Stop and Start.
+type Restarter interface {
+	Restart() error
+}
+
+// restart restarts the daemon by Restart if it's a Restarter, or by Stop and Start
+func restart(d Daemon) error {
+	if r, ok := d.(Restarter); ok {
+		return r.Restart()
+	}
+	if err := d.Stop(); err != nil && !errors.Is(err, errAlreadyStopped) {
+		return err
+	}
+	return d.Start()
+}
+
+// Artifact is a file such as a unit file or an init script written by Install
+type Artifact struct {
+	Path    string
+	Mode    os.FileMode
+	Content []byte
+}
+
+// Renderer is implemented by the daemons which can show the files written by Install without writing them,
+// all the built-in backends do
+type Renderer interface {
+	Render() ([]Artifact, error)
+}
+
 type config struct {
 	Description  string // description
 	Name         string // daemon name
 	Exec         string // executable file
 	Args         string // command line argument
 	WorkDir      string
-	Dependencies string
+	Dependencies string // raw dependencies which replace the defaults, see Deps
+	Deps         []Dep
 	User         string
 	Group        string
 	LogFile      string
 	PidFile      string
 	LockFile     string
+	Rotation     Rotation
+	LogOutput    LogOutput
+	// StderrLogFile separates stderr from the log output if it's not empty
+	StderrLogFile string
+
+	Escalation               Escalation
+	NonInteractiveEscalation bool
+
+	// CreateUser creates the user and group on Install if it's not nil
+	CreateUser *UserSpec
+
+	Directories Dirs
+
+	// Schedule runs the executable as a job on schedule if it's not nil
+	Schedule *Schedule
+	// Sockets are listened by systemd, which starts the service on demand
+	Sockets []Listen
+	// HealthCheck checks whether the running service works if it's not nil
+	HealthCheck *HealthCheck
+
+	Hooks     Hooks
+	OnInstall func() error
+	OnRemove  func() error
+
+	// Instances makes the config a template, Instance is the name of the instance chosen by Instance
+	Instances bool
+	Instance  string
+	// template is the config of the instances' template unit
+	template *config
+
+	// SupervisorServer is the XML-RPC server of supervisord, a default socket if it's empty
+	SupervisorServer string
+
+	// set by Group.Add, Requires are the services which must be started first
+	GroupName string
+	Requires  []string
+	Priority  int
 }
 
 type Configurator interface {
-	apply(c *config)
+	apply(c *config) error
 }
 
 type Option func(c *config)
 
-func (f Option) apply(c *config) {
+func (f Option) apply(c *config) error {
 	f(c)
+	return nil
 }
 func WithDescription(des string) Configurator {
 	return Option(func(c *config) {
@@ -99,6 +175,9 @@ func WithExec(exec string) Configurator {
 		c.Exec = exec
 	})
 }
+
+// WithArgs sets the command line arguments, they are split into words like a shell does
+// with quotes and backslashes, but variables and commands like $HOME or $(date) are not expanded
 func WithArgs(args string) Configurator {
 	return Option(func(c *config) {
 		c.Args = args
@@ -109,6 +188,11 @@ func WithWorkDir(workDir string) Configurator {
 		c.WorkDir = workDir
 	})
 }
+
+// WithDependencies sets the dependencies in the backend's own names, e.g. "network.target" for systemd,
+// which replace the default ones.
+//
+// Deprecated: use WithDependency, which translates the dependencies for each backend.
 func WithDependencies(deps string) Configurator {
 	return Option(func(c *config) {
 		c.Dependencies = deps
@@ -124,10 +208,10 @@ func WithGroup(group string) Configurator {
 		c.Group = group
 	})
 }
+
+// WithLogFile is the same as WithLogOutput(File(logFile))
 func WithLogFile(logFile string) Configurator {
-	return Option(func(c *config) {
-		c.LogFile = logFile
-	})
+	return WithLogOutput(File(logFile))
 }
 func WithPidFile(pidFile string) Configurator {
 	return Option(func(c *config) {
@@ -141,7 +225,15 @@ func WithLockFile(lockFile string) Configurator {
 	})
 }
 
-var selfWrapDaemon, _ = newDaemon(defaultConfig())
+var selfWrapDaemon, _ = newSelfWrapDaemon()
+
+func newSelfWrapDaemon() (Daemon, error) {
+	conf := defaultConfig()
+	if err := setupConfig(conf); err != nil {
+		return nil, err
+	}
+	return newDaemon(conf)
+}
 
 func Install() error {
 	if selfWrapDaemon == nil {
@@ -171,6 +263,13 @@ func Remove() error {
 	return selfWrapDaemon.Remove()
 }
 
+func RemoveWith(opts RemoveOptions) error {
+	if selfWrapDaemon == nil {
+		return errUnsupportedSystem
+	}
+	return removeWith(selfWrapDaemon, opts)
+}
+
 func Start() error {
 	if selfWrapDaemon == nil {
 		return errUnsupportedSystem
@@ -185,6 +284,13 @@ func Stop() error {
 	return selfWrapDaemon.Stop()
 }
 
+func Restart() error {
+	if selfWrapDaemon == nil {
+		return errUnsupportedSystem
+	}
+	return restart(selfWrapDaemon)
+}
+
 func Status() error {
 	if selfWrapDaemon == nil {
 		return errUnsupportedSystem
@@ -199,14 +305,87 @@ func Log() error {
 	return selfWrapDaemon.Log()
 }
 
+func Logs(ctx context.Context, opts LogOptions) error {
+	if selfWrapDaemon == nil {
+		return errUnsupportedSystem
+	}
+	r, ok := selfWrapDaemon.(LogReader)
+	if !ok {
+		return errUnsupportedOperation
+	}
+	return r.Logs(ctx, opts)
+}
+
+func LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error) {
+	if selfWrapDaemon == nil {
+		return nil, errUnsupportedSystem
+	}
+	r, ok := selfWrapDaemon.(LogEntryReader)
+	if !ok {
+		return nil, errUnsupportedOperation
+	}
+	return r.LogEntries(ctx, opts)
+}
+
+func Render() ([]Artifact, error) {
+	if selfWrapDaemon == nil {
+		return nil, errUnsupportedSystem
+	}
+	r, ok := selfWrapDaemon.(Renderer)
+	if !ok {
+		return nil, errUnsupportedOperation
+	}
+	return r.Render()
+}
+
+func Upgrade(newExec string, opts ...UpgradeOptions) error {
+	if selfWrapDaemon == nil {
+		return errUnsupportedSystem
+	}
+	u, ok := selfWrapDaemon.(Upgrader)
+	if !ok {
+		return errUnsupportedOperation
+	}
+	return u.Upgrade(newExec, opts...)
+}
+
+func Health(ctx context.Context) error {
+	if selfWrapDaemon == nil {
+		return errUnsupportedSystem
+	}
+	h, ok := selfWrapDaemon.(HealthChecker)
+	if !ok {
+		return errUnsupportedOperation
+	}
+	return h.Health(ctx)
+}
+
+func Watch(ctx context.Context) (<-chan StateEvent, error) {
+	if selfWrapDaemon == nil {
+		return nil, errUnsupportedSystem
+	}
+	w, ok := selfWrapDaemon.(Watcher)
+	if !ok {
+		return nil, errUnsupportedOperation
+	}
+	return w.Watch(ctx)
+}
+
 func New(options ...Configurator) (Daemon, error) {
 	conf := defaultConfig()
 	for _, op := range options {
-		op.apply(conf)
+		if err := op.apply(conf); err != nil {
+			return nil, err
+		}
 	}
 	if err := setupConfig(conf); err != nil {
 		return nil, err
 	}
+	// the host is only checked by Validate, so New works where the account or the directories are missing,
+	// e.g. to render the files on a build machine or to remove the service
+	if err := conf.validate(false); err != nil {
+		return nil, err
+	}
 	return newDaemon(conf)
 }
 
@@ -217,10 +396,25 @@ func newDaemon(c *config) (d Daemon, err error) {
 	}
 	switch initProgramName {
 	case "supervisor":
-		return &supervisord{c}, nil
+		if c.Schedule != nil {
+			return nil, errScheduleUnsupported
+		}
+		if len(c.Sockets) > 0 {
+			return nil, errSocketUnsupported
+		}
+		c.defaultLogOutput(File(c.LogFile))
+		return withInstances(c, func(c *config) Daemon { return &supervisord{c} }), nil
 	case "init":
-		return &systemv{c}, nil
+		if len(c.Sockets) > 0 {
+			return nil, errSocketUnsupported
+		}
+		c.defaultLogOutput(File(c.LogFile))
+		if c.Schedule != nil {
+			return &cronJob{c}, nil
+		}
+		return withInstances(c, func(c *config) Daemon { return &systemv{c} }), nil
 	case "systemd":
+		c.defaultLogOutput(Journal)
 		return &systemd{c}, nil
 	}
 	return nil, errUnsupportedSystem
@@ -239,9 +433,42 @@ func setupConfig(conf *config) error {
 	if conf.WorkDir == "" {
 		conf.WorkDir = path.Dir(conf.Exec)
 	}
+	// a log file loaded from a file or the environment chooses the file output as WithLogFile does
+	if conf.LogOutput.kind == autoOutput && conf.LogFile != "" {
+		conf.LogOutput = File(conf.LogFile)
+	}
+	// a rotation loaded from a file may leave Keep zero as well as WithLogRotation
+	if conf.Rotation.Keep == 0 {
+		conf.Rotation.Keep = defaultRotationKeep
+	}
+	// the defaults below derive from the name, which may have been changed by the options,
+	// each instance has its own files
+	name := conf.Name
+	if conf.Instances {
+		name += "@" + instanceSpecifier
+	}
+	if conf.LogFile == "" {
+		conf.LogFile = fmt.Sprintf(defaultLogFile, conf.Name, name)
+	}
+	if conf.Description == "" {
+		conf.Description = fmt.Sprintf(defaultDescription, name)
+	}
+	if conf.PidFile == "" {
+		conf.PidFile = fmt.Sprintf(defaultPidFile, name)
+	}
+	if conf.LockFile == "" {
+		conf.LockFile = fmt.Sprintf(defaultLockFile, name)
+	}
 	return nil
 }
 
+// defaultLogOutput sets the backend's log output if it hasn't been chosen by the options
+func (c *config) defaultLogOutput(output LogOutput) {
+	if c.LogOutput.kind == autoOutput {
+		c.LogOutput = output
+	}
+}
+
 func defaultConfig() *config {
 	p, err := filepath.Abs(os.Args[0])
 	if err != nil {
@@ -249,14 +476,9 @@ func defaultConfig() *config {
 	}
 	conf := &config{}
 	conf.Exec = p
-	conf.Name = path.Base(conf.Exec)
-	conf.WorkDir = path.Dir(conf.Exec)
-	conf.LogFile = fmt.Sprintf(defaultLogFile, conf.Name, conf.Name)
-	conf.Description = fmt.Sprintf(defaultDescription, conf.Name)
 	conf.User = defaultUser
 	conf.Group = defaultGroup
-	conf.PidFile = fmt.Sprintf(defaultPidFile, conf.Name)
-	conf.LockFile = fmt.Sprintf(defaultLockFile, conf.Name)
+	conf.Rotation = defaultRotation()
 	return conf
 }
 
@@ -292,35 +514,75 @@ func executablePath(name string) (string, error) {
 	return filepath.Abs(lp)
 }
 
-// Check root rights to use system service
-func checkPrivileges() error {
-	if output, err := exec.Command("id", "-g").Output(); err == nil {
-		if gid, parseErr := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 32); parseErr == nil {
-			if gid == 0 {
-				return nil
-			}
-			return errRootPrivileges
-		}
+// templateFuncs are the helpers available in all the templates
+var templateFuncs = template.FuncMap{
+	"logKind":         logKind,
+	"logFacility":     logFacility,
+	"dirSettings":     dirSettings,
+	"keepInstance":    keepInstance,
+	"systemdDeps":     systemdDeps,
+	"lsbDeps":         lsbDeps,
+	"timerSpan":       timerSpan,
+	"listenDirective": listenDirective,
+	"systemdHook":     systemdHook,
+	"shellHook":       shellHook,
+	"listenerPath":    supervisordListenerPath,
+	"eventsLog":       supervisordEventsLog,
+	// escaping of the values in the service files, see escape.go
+	"systemdValue":   systemdValue,
+	"systemdExec":    systemdExec,
+	"iniValue":       iniValue,
+	"iniCommand":     iniCommand,
+	"iniHookCommand": iniHookCommand,
+	"shellQuote":     shellQuote,
+	"shellValue":     shellValue,
+	"shellCommand":   shellCommand,
+	"logrotatePath":  logrotatePath,
+	"commentValue":   commentValue,
+	"safeName":       safeName,
+	"systemdDir":     systemdDir,
+}
+
+// renderTemplate executes the named template text with the config or other data
+func renderTemplate(name, text string, c interface{}) ([]byte, error) {
+	tpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, c); err != nil {
+		return nil, err
 	}
-	return errUnsupportedSystem
+	return buf.Bytes(), nil
 }
 
-func execCommandWithOutput(name string, arg ...string) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// renderConfig returns a copy of the config with the executable path resolved if possible,
+// the executable may not exist on the host which only renders the service files
+func renderConfig(c *config) *config {
+	rc := *c
+	if p, err := executablePath(rc.Exec); err == nil {
+		rc.Exec = p
+	}
+	return &rc
+}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sig
-		cancel()
+// writeFiles writes the rendered files atomically and removes the written ones if any of them fails
+func writeFiles(files []Artifact) (err error) {
+	written := make([]string, 0, len(files))
+	defer func() {
+		if err != nil {
+			for _, p := range written {
+				_ = os.Remove(p)
+			}
+		}
 	}()
-
-	cmd := exec.CommandContext(ctx, name, arg...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+	for _, f := range files {
+		if err = writeFileAtomic(f.Path, f.Content, f.Mode); err != nil {
+			return err
+		}
+		written = append(written, f.Path)
+	}
+	return nil
 }
 
 func pathOrFileIsExist(path string) bool {
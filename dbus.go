@@ -0,0 +1,797 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errBusAddress appears if the address of the system bus has no unix socket
+	errBusAddress = errors.New("expect a unix:path= or unix:abstract= address of the system bus")
+
+	// errBusAuth appears if the bus rejects the EXTERNAL authentication
+	errBusAuth = errors.New("the system bus rejected the authentication")
+
+	// errBusMessage appears if a message on the bus can't be decoded
+	errBusMessage = errors.New("malformed D-Bus message")
+
+	// errUnitFailed appears if a unit ends up failed after it's started, or a job of the unit isn't done
+	errUnitFailed = errors.New("the unit failed, see the status and the log for details")
+
+	// errJobTimeout appears if a job of systemd doesn't finish in busJobTimeout
+	errJobTimeout = errors.New("the job of systemd didn't finish in time")
+)
+
+const (
+	// defaultSystemBus is used if DBUS_SYSTEM_BUS_ADDRESS isn't set
+	defaultSystemBus = "unix:path=/var/run/dbus/system_bus_socket"
+
+	// busTimeout limits the connection and each call
+	busTimeout = 30 * time.Second
+
+	// busJobTimeout limits the wait for a job, it's longer than the default start and stop timeouts of systemd
+	busJobTimeout = 5 * time.Minute
+
+	// jobRemovedMatch is the match rule of the signal which systemd sends with the result of a job
+	jobRemovedMatch = "type='signal',sender='" + systemdDest + "',path='" + systemdPath + "',interface='" +
+		systemdManager + "',member='JobRemoved'"
+
+	// maxBusDepth limits the nesting of the decoded values, the spec allows 32 arrays and 32 structs
+	maxBusDepth = 64
+)
+
+// the names of systemd on the bus
+const (
+	systemdDest       = "org.freedesktop.systemd1"
+	systemdPath       = "/org/freedesktop/systemd1"
+	systemdManager    = "org.freedesktop.systemd1.Manager"
+	systemdUnitIface  = "org.freedesktop.systemd1.Unit"
+	systemdServiceIfc = "org.freedesktop.systemd1.Service"
+	systemdJobIface   = "org.freedesktop.systemd1.Job"
+	busProperties     = "org.freedesktop.DBus.Properties"
+)
+
+// the message types and the header fields of the D-Bus wire protocol
+const (
+	busMethodCall   = 1
+	busMethodReturn = 2
+	busError        = 3
+	busSignal       = 4
+
+	busFieldPath        = 1
+	busFieldInterface   = 2
+	busFieldMember      = 3
+	busFieldErrorName   = 4
+	busFieldReplySerial = 5
+	busFieldDestination = 6
+	busFieldSignature   = 8
+)
+
+// busErrorReply is an error returned by the peer, such as org.freedesktop.systemd1.NoSuchUnit
+type busErrorReply struct {
+	Name    string
+	Message string
+}
+
+func (e *busErrorReply) Error() string {
+	return e.Name + ": " + e.Message
+}
+
+// isBusUnreachable reports whether the error is one of the connection or of the messages, systemctl is used instead
+// if the connection fails before a call of the operation is written, see withSystemBus. The error replies
+// and the errors made of the answers, such as errUnitFailed, are not.
+func isBusUnreachable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errBusAddress) || errors.Is(err, errBusAuth) || errors.Is(err, errBusMessage)
+}
+
+// busConn is a connection to the system bus, it's used by one goroutine
+type busConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	serial uint32
+	jobs   map[string]string // the results of the removed jobs by their paths
+	sent   bool              // a call has been written since the connection was set up
+}
+
+// dialSystemBus connects to the system bus set by DBUS_SYSTEM_BUS_ADDRESS, the standard socket by default
+func dialSystemBus() (*busConn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = defaultSystemBus
+	}
+	network, path, err := busSocket(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(network, path, busTimeout)
+	if err != nil {
+		return nil, err
+	}
+	bus := &busConn{conn: conn, r: bufio.NewReader(conn)}
+	if err = bus.auth(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if _, err = bus.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	bus.sent = false
+	return bus, nil
+}
+
+// busSocket finds the unix socket in the address, which is a list of transports separated by semicolons
+func busSocket(address string) (network, path string, err error) {
+	for _, transport := range strings.Split(address, ";") {
+		if !strings.HasPrefix(transport, "unix:") {
+			continue
+		}
+		for _, kv := range strings.Split(strings.TrimPrefix(transport, "unix:"), ",") {
+			switch {
+			case strings.HasPrefix(kv, "path="):
+				return "unix", unescapeBusValue(strings.TrimPrefix(kv, "path=")), nil
+			case strings.HasPrefix(kv, "abstract="):
+				return "unix", "@" + unescapeBusValue(strings.TrimPrefix(kv, "abstract=")), nil
+			}
+		}
+	}
+	return "", "", errBusAddress
+}
+
+// unescapeBusValue decodes the %xx escapes of a value in a bus address
+func unescapeBusValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			if c, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// auth authenticates by the uid of the process, which the bus reads from the socket
+func (b *busConn) auth() error {
+	_ = b.conn.SetDeadline(time.Now().Add(busTimeout))
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := b.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+	line, err := b.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return errBusAuth
+	}
+	_, err = b.conn.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+func (b *busConn) Close() error {
+	return b.conn.Close()
+}
+
+// call calls the method and returns the values of the reply,
+// args are encoded by the signature, which supports the basic types and arrays of them
+func (b *busConn) call(dest, path, iface, member, signature string, args ...interface{}) ([]interface{}, error) {
+	b.serial++
+	msg, err := encodeBusCall(b.serial, dest, path, iface, member, signature, args...)
+	if err != nil {
+		return nil, err
+	}
+	_ = b.conn.SetDeadline(time.Now().Add(busTimeout))
+	if _, err = b.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	b.sent = true
+	for {
+		reply, err := b.read()
+		if err != nil {
+			return nil, err
+		}
+		// the signals and the replies of other calls are skipped
+		if reply.replySerial != b.serial || (reply.msgType != busMethodReturn && reply.msgType != busError) {
+			continue
+		}
+		if reply.msgType == busError {
+			e := &busErrorReply{Name: reply.errorName}
+			if len(reply.body) > 0 {
+				e.Message, _ = reply.body[0].(string)
+			}
+			return nil, e
+		}
+		return reply.body, nil
+	}
+}
+
+// read reads the next message and keeps the result of a job from its JobRemoved signal,
+// which may come before the reply of the call waiting for it
+func (b *busConn) read() (*busMessage, error) {
+	msg, err := readBusMessage(b.r)
+	if err != nil {
+		return nil, err
+	}
+	if msg.msgType == busSignal && msg.iface == systemdManager && msg.member == "JobRemoved" && len(msg.body) == 4 {
+		// the body is the id, the path, the unit and the result of the job
+		job, _ := msg.body[1].(string)
+		result, _ := msg.body[3].(string)
+		if b.jobs == nil {
+			b.jobs = make(map[string]string)
+		}
+		b.jobs[job] = result
+	}
+	return msg, nil
+}
+
+// busHeaderField is a header field of a method call, all of them have string values
+type busHeaderField struct {
+	code      byte
+	signature string
+	value     string
+}
+
+func encodeBusCall(serial uint32, dest, path, iface, member, signature string, args ...interface{}) ([]byte, error) {
+	body := &busEncoder{order: binary.LittleEndian}
+	if err := body.values(signature, args); err != nil {
+		return nil, err
+	}
+
+	h := &busEncoder{order: binary.LittleEndian}
+	h.buf.Write([]byte{'l', busMethodCall, 0, 1})
+	h.uint32(uint32(body.buf.Len()))
+	h.uint32(serial)
+	fields := []busHeaderField{
+		{busFieldPath, "o", path},
+		{busFieldInterface, "s", iface},
+		{busFieldMember, "s", member},
+		{busFieldDestination, "s", dest},
+	}
+	if signature != "" {
+		fields = append(fields, busHeaderField{busFieldSignature, "g", signature})
+	}
+	// the header fields are an array of (byte, variant) structs
+	lengthAt := h.buf.Len()
+	h.uint32(0)
+	h.align(8)
+	start := h.buf.Len()
+	for _, f := range fields {
+		h.align(8)
+		h.buf.WriteByte(f.code)
+		h.signature(f.signature)
+		if err := h.value(f.signature, f.value); err != nil {
+			return nil, err
+		}
+	}
+	h.order.PutUint32(h.buf.Bytes()[lengthAt:], uint32(h.buf.Len()-start))
+	h.align(8)
+	return append(h.buf.Bytes(), body.buf.Bytes()...), nil
+}
+
+// busMessage is a decoded message, only the fields used to match the replies and the signals are kept
+type busMessage struct {
+	msgType     byte
+	replySerial uint32
+	errorName   string
+	iface       string
+	member      string
+	body        []interface{}
+}
+
+func readBusMessage(r io.Reader) (*busMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, errBusMessage
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	if bodyLen > 1<<27 || fieldsLen > 1<<26 {
+		return nil, errBusMessage
+	}
+	headerLen := 16 + int(fieldsLen)
+	headerLen += (8 - headerLen%8) % 8
+	data := make([]byte, headerLen+int(bodyLen))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	d := &busDecoder{order: order, data: data[:16+fieldsLen], pos: 12}
+	fields, err := d.value("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	msg := &busMessage{msgType: fixed[1]}
+	signature := ""
+	for _, field := range fields.([]interface{}) {
+		f := field.([]interface{})
+		switch f[0].(byte) {
+		case busFieldReplySerial:
+			msg.replySerial, _ = f[1].(uint32)
+		case busFieldErrorName:
+			msg.errorName, _ = f[1].(string)
+		case busFieldInterface:
+			msg.iface, _ = f[1].(string)
+		case busFieldMember:
+			msg.member, _ = f[1].(string)
+		case busFieldSignature:
+			signature, _ = f[1].(string)
+		}
+	}
+	body := &busDecoder{order: order, data: data[headerLen:]}
+	for signature != "" {
+		var t string
+		if t, signature, err = nextBusType(signature); err != nil {
+			return nil, err
+		}
+		v, err := body.value(t)
+		if err != nil {
+			return nil, err
+		}
+		msg.body = append(msg.body, v)
+	}
+	return msg, nil
+}
+
+// nextBusType splits the first complete type off the signature
+func nextBusType(signature string) (string, string, error) {
+	if signature == "" {
+		return "", "", errBusMessage
+	}
+	switch signature[0] {
+	case 'a':
+		elem, rest, err := nextBusType(signature[1:])
+		return "a" + elem, rest, err
+	case '(', '{':
+		closing := byte(')')
+		if signature[0] == '{' {
+			closing = '}'
+		}
+		depth := 0
+		for i := 0; i < len(signature); i++ {
+			switch signature[i] {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+				if depth == 0 {
+					if signature[i] != closing {
+						return "", "", errBusMessage
+					}
+					return signature[:i+1], signature[i+1:], nil
+				}
+			}
+		}
+		return "", "", errBusMessage
+	}
+	return signature[:1], signature[1:], nil
+}
+
+// busAlignment is the alignment of the type starting the signature
+func busAlignment(t byte) int {
+	switch t {
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 'h', 's', 'o', 'a':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+type busEncoder struct {
+	order binary.ByteOrder
+	buf   bytes.Buffer
+}
+
+func (e *busEncoder) align(n int) {
+	for e.buf.Len()%n != 0 {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *busEncoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *busEncoder) signature(s string) {
+	e.buf.WriteByte(byte(len(s)))
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func (e *busEncoder) values(signature string, args []interface{}) error {
+	for _, arg := range args {
+		t, rest, err := nextBusType(signature)
+		if err != nil {
+			return err
+		}
+		if err = e.value(t, arg); err != nil {
+			return err
+		}
+		signature = rest
+	}
+	if signature != "" {
+		return fmt.Errorf("missing D-Bus arguments for %q", signature)
+	}
+	return nil
+}
+
+// value encodes the Go value of a string, bool, int32, uint32 or string array type
+func (e *busEncoder) value(t string, v interface{}) error {
+	ok := false
+	switch t {
+	case "s", "o":
+		var s string
+		if s, ok = v.(string); ok {
+			e.uint32(uint32(len(s)))
+			e.buf.WriteString(s)
+			e.buf.WriteByte(0)
+		}
+	case "g":
+		var s string
+		if s, ok = v.(string); ok {
+			e.signature(s)
+		}
+	case "b":
+		var b bool
+		if b, ok = v.(bool); ok {
+			n := uint32(0)
+			if b {
+				n = 1
+			}
+			e.uint32(n)
+		}
+	case "i":
+		var n int32
+		if n, ok = v.(int32); ok {
+			e.uint32(uint32(n))
+		}
+	case "u":
+		var n uint32
+		if n, ok = v.(uint32); ok {
+			e.uint32(n)
+		}
+	case "as":
+		var list []string
+		if list, ok = v.([]string); ok {
+			e.uint32(0)
+			lengthAt := e.buf.Len() - 4
+			start := e.buf.Len()
+			for _, s := range list {
+				_ = e.value("s", s)
+			}
+			e.order.PutUint32(e.buf.Bytes()[lengthAt:], uint32(e.buf.Len()-start))
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unsupported D-Bus argument %T for %q", v, t)
+	}
+	return nil
+}
+
+type busDecoder struct {
+	order binary.ByteOrder
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *busDecoder) align(n int) error {
+	d.pos += (n - d.pos%n) % n
+	if d.pos > len(d.data) {
+		return errBusMessage
+	}
+	return nil
+}
+
+func (d *busDecoder) read(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) {
+		return nil, errBusMessage
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// value decodes a complete type into byte, bool, int16, uint16, int32, uint32, int64, uint64, float64, string,
+// []interface{} for arrays and structs, and map[string]interface{} for dictionaries, variants are unwrapped
+func (d *busDecoder) value(t string) (interface{}, error) {
+	// a variant can hold another one, so the nesting isn't limited by the signature
+	if d.depth >= maxBusDepth {
+		return nil, errBusMessage
+	}
+	d.depth++
+	defer func() {
+		d.depth--
+	}()
+	if err := d.align(busAlignment(t[0])); err != nil {
+		return nil, err
+	}
+	size := map[byte]int{'y': 1, 'n': 2, 'q': 2, 'b': 4, 'i': 4, 'u': 4, 'h': 4, 'x': 8, 't': 8, 'd': 8}[t[0]]
+	if size > 0 {
+		b, err := d.read(size)
+		if err != nil {
+			return nil, err
+		}
+		switch t[0] {
+		case 'y':
+			return b[0], nil
+		case 'n':
+			return int16(d.order.Uint16(b)), nil
+		case 'q':
+			return d.order.Uint16(b), nil
+		case 'b':
+			return d.order.Uint32(b) != 0, nil
+		case 'i':
+			return int32(d.order.Uint32(b)), nil
+		case 'u', 'h':
+			return d.order.Uint32(b), nil
+		case 'x':
+			return int64(d.order.Uint64(b)), nil
+		case 't':
+			return d.order.Uint64(b), nil
+		default:
+			return math.Float64frombits(d.order.Uint64(b)), nil
+		}
+	}
+	switch t[0] {
+	case 's', 'o':
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.read(int(d.order.Uint32(b)) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'g':
+		n, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.read(int(n[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'v':
+		sig, err := d.value("g")
+		if err != nil {
+			return nil, err
+		}
+		if _, rest, err := nextBusType(sig.(string)); err != nil || rest != "" {
+			return nil, errBusMessage
+		}
+		return d.value(sig.(string))
+	case 'a':
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		elem := t[1:]
+		if err = d.align(busAlignment(elem[0])); err != nil {
+			return nil, err
+		}
+		end := d.pos + int(d.order.Uint32(b))
+		if end > len(d.data) {
+			return nil, errBusMessage
+		}
+		if elem[0] == '{' {
+			dict := make(map[string]interface{})
+			for d.pos < end {
+				entry, err := d.value(elem)
+				if err != nil {
+					return nil, err
+				}
+				kv := entry.([]interface{})
+				if len(kv) != 2 {
+					return nil, errBusMessage
+				}
+				dict[fmt.Sprint(kv[0])] = kv[1]
+			}
+			return dict, nil
+		}
+		list := []interface{}{}
+		for d.pos < end {
+			v, err := d.value(elem)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case '(', '{':
+		var fields []interface{}
+		inner := t[1 : len(t)-1]
+		for inner != "" {
+			var ft string
+			var err error
+			if ft, inner, err = nextBusType(inner); err != nil {
+				return nil, err
+			}
+			v, err := d.value(ft)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, v)
+		}
+		return fields, nil
+	}
+	return nil, errBusMessage
+}
+
+// unitProperties are the properties of a unit read over D-Bus or by systemctl show
+type unitProperties struct {
+	ActiveState    string
+	SubState       string
+	MainPID        int
+	ExecMainCode   int
+	ExecMainStatus int
+	NRestarts      int
+}
+
+// unitProperties reads the properties of the unit, the ones of a service are only set for a .service unit
+func (b *busConn) unitProperties(unit string) (unitProperties, error) {
+	var props unitProperties
+	path, err := busValue(b.call(systemdDest, systemdPath, systemdManager, "LoadUnit", "s", unit))
+	if err != nil {
+		return props, err
+	}
+	unitPath, _ := path.(string)
+	all, err := b.getAll(unitPath, systemdUnitIface)
+	if err != nil {
+		return props, err
+	}
+	props.ActiveState, _ = all["ActiveState"].(string)
+	props.SubState, _ = all["SubState"].(string)
+	if !strings.HasSuffix(unit, ".service") {
+		return props, nil
+	}
+	if all, err = b.getAll(unitPath, systemdServiceIfc); err != nil {
+		return props, err
+	}
+	props.MainPID = busInt(all["MainPID"])
+	props.ExecMainCode = busInt(all["ExecMainCode"])
+	props.ExecMainStatus = busInt(all["ExecMainStatus"])
+	props.NRestarts = busInt(all["NRestarts"])
+	return props, nil
+}
+
+func (b *busConn) getAll(path, iface string) (map[string]interface{}, error) {
+	value, err := busValue(b.call(systemdDest, path, busProperties, "GetAll", "s", iface))
+	if err != nil {
+		return nil, err
+	}
+	all, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errBusMessage
+	}
+	return all, nil
+}
+
+// busValue returns the first value of the reply of a call, a reply without any value is malformed
+func busValue(values []interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errBusMessage
+	}
+	return values[0], nil
+}
+
+func busInt(v interface{}) int {
+	switch n := v.(type) {
+	case int32:
+		return int(n)
+	case uint32:
+		return int(n)
+	}
+	return 0
+}
+
+// runJob calls the method of the manager which queues a job for the unit, such as StartUnit,
+// and waits for the JobRemoved signal of the job, any result but done fails it
+func (b *busConn) runJob(method, unit string) error {
+	// systemd only sends the signals to the subscribed clients
+	_, err := b.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", "s", jobRemovedMatch)
+	if err != nil {
+		return err
+	}
+	if _, err = b.call(systemdDest, systemdPath, systemdManager, "Subscribe", ""); err != nil {
+		return err
+	}
+	value, err := busValue(b.call(systemdDest, systemdPath, systemdManager, method, "ss", unit, "replace"))
+	if err != nil {
+		return err
+	}
+	job, _ := value.(string)
+	result, err := b.waitJob(job)
+	if err != nil {
+		return err
+	}
+	if result != "done" {
+		return fmt.Errorf("%s %s: the job is %s: %w", method, unit, result, errUnitFailed)
+	}
+	return nil
+}
+
+// waitJob reads the messages until the job is removed and returns its result, such as done or failed
+func (b *busConn) waitJob(job string) (string, error) {
+	_ = b.conn.SetDeadline(time.Now().Add(busJobTimeout))
+	for {
+		if result, ok := b.jobs[job]; ok {
+			return result, nil
+		}
+		if _, err := b.read(); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", fmt.Errorf("%s: %w", job, errJobTimeout)
+			}
+			return "", err
+		}
+	}
+}
+
+func (b *busConn) reload() error {
+	_, err := b.call(systemdDest, systemdPath, systemdManager, "Reload", "")
+	return err
+}
+
+// enableUnitFiles enables the units like systemctl enable, without force a link to another unit file is left alone
+func (b *busConn) enableUnitFiles(units ...string) error {
+	_, err := b.call(systemdDest, systemdPath, systemdManager, "EnableUnitFiles", "asbb", units, false, false)
+	if err != nil {
+		return err
+	}
+	return b.reload()
+}
+
+func (b *busConn) disableUnitFiles(units ...string) error {
+	_, err := b.call(systemdDest, systemdPath, systemdManager, "DisableUnitFiles", "asb", units, false)
+	if err != nil {
+		return err
+	}
+	return b.reload()
+}
+
+func (b *busConn) unitFileState(unit string) (string, error) {
+	value, err := busValue(b.call(systemdDest, systemdPath, systemdManager, "GetUnitFileState", "s", unit))
+	if err != nil {
+		return "", err
+	}
+	state, _ := value.(string)
+	return state, nil
+}
@@ -0,0 +1,553 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// busReply is the answer of the fake bus to a call, an error if errorName is set
+type busReply struct {
+	signature string
+	encode    func(e *busEncoder)
+	errorName string
+	message   string
+	drop      bool // close the connection instead of replying
+	iface     string
+	member    string     // the interface and the member of a signal
+	signals   []busReply // the signals sent after the reply
+}
+
+// busReturn replies the values of a signature supported by busEncoder
+func busReturn(signature string, args ...interface{}) busReply {
+	return busReply{signature: signature, encode: func(e *busEncoder) { _ = e.values(signature, args) }}
+}
+
+// busDict replies the properties like GetAll, the values are strings, int32s and uint32s
+func busDict(props map[string]interface{}) busReply {
+	return busReply{signature: "a{sv}", encode: func(e *busEncoder) {
+		e.uint32(0)
+		lengthAt := e.buf.Len() - 4
+		e.align(8)
+		start := e.buf.Len()
+		for name, v := range props {
+			e.align(8)
+			_ = e.value("s", name)
+			t := map[string]string{"string": "s", "int32": "i", "uint32": "u"}[fmt.Sprintf("%T", v)]
+			e.signature(t)
+			_ = e.value(t, v)
+		}
+		e.order.PutUint32(e.buf.Bytes()[lengthAt:], uint32(e.buf.Len()-start))
+	}}
+}
+
+func busErrorOf(name, message string) busReply {
+	return busReply{errorName: name, message: message}
+}
+
+// encodeBusReply encodes the reply to the call with the serial, the serial of the reply is zero for a signal
+func encodeBusReply(msgType byte, serial, replySerial uint32, reply busReply) []byte {
+	body := &busEncoder{order: binary.LittleEndian}
+	signature := reply.signature
+	if reply.errorName != "" {
+		signature = "s"
+		_ = body.value("s", reply.message)
+	} else if reply.encode != nil {
+		reply.encode(body)
+	}
+
+	h := &busEncoder{order: binary.LittleEndian}
+	h.buf.Write([]byte{'l', msgType, 0, 1})
+	h.uint32(uint32(body.buf.Len()))
+	h.uint32(serial)
+	lengthAt := h.buf.Len()
+	h.uint32(0)
+	h.align(8)
+	start := h.buf.Len()
+	field := func(code byte, t string, v interface{}) {
+		h.align(8)
+		h.buf.WriteByte(code)
+		h.signature(t)
+		_ = h.value(t, v)
+	}
+	if replySerial != 0 {
+		field(busFieldReplySerial, "u", replySerial)
+	}
+	if reply.errorName != "" {
+		field(busFieldErrorName, "s", reply.errorName)
+	}
+	if reply.member != "" {
+		field(busFieldInterface, "s", reply.iface)
+		field(busFieldMember, "s", reply.member)
+	}
+	if signature != "" {
+		field(busFieldSignature, "g", signature)
+	}
+	h.order.PutUint32(h.buf.Bytes()[lengthAt:], uint32(h.buf.Len()-start))
+	h.align(8)
+	return append(h.buf.Bytes(), body.buf.Bytes()...)
+}
+
+// busCall is a method call read by the fake bus
+type busCall struct {
+	serial uint32
+	path   string
+	member string
+	args   []interface{}
+}
+
+func readBusCall(r io.Reader) (*busCall, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[0] != 'l' || fixed[1] != busMethodCall {
+		return nil, errBusMessage
+	}
+	bodyLen := binary.LittleEndian.Uint32(fixed[4:])
+	fieldsLen := binary.LittleEndian.Uint32(fixed[12:])
+	headerLen := 16 + int(fieldsLen)
+	headerLen += (8 - headerLen%8) % 8
+	data := make([]byte, headerLen+int(bodyLen))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	d := &busDecoder{order: binary.LittleEndian, data: data[:16+fieldsLen], pos: 12}
+	fields, err := d.value("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	call := &busCall{serial: binary.LittleEndian.Uint32(fixed[8:])}
+	signature := ""
+	for _, field := range fields.([]interface{}) {
+		f := field.([]interface{})
+		switch f[0].(byte) {
+		case busFieldPath:
+			call.path, _ = f[1].(string)
+		case busFieldMember:
+			call.member, _ = f[1].(string)
+		case busFieldSignature:
+			signature, _ = f[1].(string)
+		}
+	}
+	body := &busDecoder{order: binary.LittleEndian, data: data[headerLen:]}
+	for signature != "" {
+		var t string
+		if t, signature, err = nextBusType(signature); err != nil {
+			return nil, err
+		}
+		v, err := body.value(t)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, v)
+	}
+	return call, nil
+}
+
+// fakeBus is the system bus with systemd on it, the handler of a member answers its calls
+type fakeBus struct {
+	reject   bool
+	mu       sync.Mutex
+	calls    []string
+	handlers map[string]func(call *busCall) busReply
+}
+
+// listenFakeBus serves the fake bus on a unix socket and points DBUS_SYSTEM_BUS_ADDRESS to it
+func listenFakeBus(t *testing.T) *fakeBus {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "system_bus_socket")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "tcp:host=localhost;unix:path="+strings.Replace(sock, "_", "%5f", -1))
+
+	bus := &fakeBus{handlers: map[string]func(call *busCall) busReply{
+		"Hello":     func(*busCall) busReply { return busReturn("s", ":1.42") },
+		"AddMatch":  func(*busCall) busReply { return busReturn("") },
+		"Subscribe": func(*busCall) busReply { return busReturn("") },
+	}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go bus.serve(conn)
+		}
+	}()
+	return bus
+}
+
+func (b *fakeBus) handle(member string, handler func(call *busCall) busReply) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[member] = handler
+}
+
+func (b *fakeBus) takeCalls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	calls := b.calls
+	b.calls = nil
+	return calls
+}
+
+func (b *fakeBus) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	b.mu.Lock()
+	reject := b.reject
+	b.mu.Unlock()
+	if err != nil || line != "\x00AUTH EXTERNAL "+uid+"\r\n" || reject {
+		_, _ = conn.Write([]byte("REJECTED EXTERNAL\r\n"))
+		return
+	}
+	_, _ = conn.Write([]byte("OK 0123456789abcdef0123456789abcdef\r\n"))
+	if line, err = r.ReadString('\n'); err != nil || line != "BEGIN\r\n" {
+		return
+	}
+
+	var serial uint32
+	for {
+		call, err := readBusCall(r)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.calls = append(b.calls, strings.TrimSpace(call.member+" "+call.path+" "+strings.TrimSuffix(fmt.Sprintln(call.args...), "\n")))
+		handler, ok := b.handlers[call.member]
+		b.mu.Unlock()
+		reply := busErrorOf("org.freedesktop.DBus.Error.UnknownMethod", "unknown method "+call.member)
+		if ok {
+			reply = handler(call)
+		}
+		if reply.drop {
+			return
+		}
+
+		// a signal comes before each reply, it's skipped by the client
+		serial++
+		_, _ = conn.Write(encodeBusReply(busSignal, serial, 0, busReturn("s", "NameAcquired")))
+		serial++
+		msgType := byte(busMethodReturn)
+		if reply.errorName != "" {
+			msgType = busError
+		}
+		_, _ = conn.Write(encodeBusReply(msgType, serial, call.serial, reply))
+		for _, signal := range reply.signals {
+			serial++
+			_, _ = conn.Write(encodeBusReply(busSignal, serial, 0, signal))
+		}
+	}
+}
+
+const fakeUnitPath = "/org/freedesktop/systemd1/unit/svc_2eservice"
+
+// serveUnit answers LoadUnit and GetAll with the unit in the state
+func (b *fakeBus) serveUnit(activeState string) {
+	b.handle("LoadUnit", func(*busCall) busReply { return busReturn("o", fakeUnitPath) })
+	b.handle("GetAll", func(call *busCall) busReply {
+		if call.args[0] == systemdServiceIfc {
+			return busDict(map[string]interface{}{
+				"MainPID":        uint32(42),
+				"ExecMainCode":   int32(1),
+				"ExecMainStatus": int32(3),
+				"NRestarts":      uint32(2),
+			})
+		}
+		return busDict(map[string]interface{}{"ActiveState": activeState, "SubState": "running", "Id": "svc.service"})
+	})
+}
+
+func dialFakeBus(t *testing.T) *busConn {
+	t.Helper()
+	conn, err := dialSystemBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestBusUnitProperties(t *testing.T) {
+	bus := listenFakeBus(t)
+	bus.serveUnit("active")
+	conn := dialFakeBus(t)
+
+	props, err := conn.unitProperties("svc.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := unitProperties{ActiveState: "active", SubState: "running", MainPID: 42, ExecMainCode: 1, ExecMainStatus: 3, NRestarts: 2}
+	if props != want {
+		t.Errorf("unitProperties = %+v, want %+v", props, want)
+	}
+	wantCalls := []string{
+		"Hello /org/freedesktop/DBus",
+		"LoadUnit " + systemdPath + " svc.service",
+		"GetAll " + fakeUnitPath + " " + systemdUnitIface,
+		"GetAll " + fakeUnitPath + " " + systemdServiceIfc,
+	}
+	if calls := bus.takeCalls(); !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("calls\n%q\nwant\n%q", calls, wantCalls)
+	}
+
+	// only a service has the properties of a service
+	if props, err = conn.unitProperties("svc.timer"); err != nil || props.MainPID != 0 {
+		t.Errorf("unitProperties of a timer = %+v, %v", props, err)
+	}
+	if calls := bus.takeCalls(); len(calls) != 2 {
+		t.Errorf("calls of a timer = %q, want LoadUnit and GetAll of the unit", calls)
+	}
+}
+
+// jobRemoved replies the job and sends its JobRemoved signal with the result
+func jobRemoved(job, unit, result string) busReply {
+	reply := busReturn("o", job)
+	signal := busReturn("uoss", uint32(7), job, unit, result)
+	signal.iface, signal.member = systemdManager, "JobRemoved"
+	// the removal of another job is skipped
+	other := busReturn("uoss", uint32(6), "/org/freedesktop/systemd1/job/6", unit, "failed")
+	other.iface, other.member = systemdManager, "JobRemoved"
+	reply.signals = []busReply{other, signal}
+	return reply
+}
+
+func TestBusRunJob(t *testing.T) {
+	bus := listenFakeBus(t)
+	bus.serveUnit("failed")
+	const job = "/org/freedesktop/systemd1/job/7"
+	bus.handle("StartUnit", func(*busCall) busReply { return jobRemoved(job, "svc.service", "done") })
+	bus.handle("StopUnit", func(*busCall) busReply { return jobRemoved(job, "svc.service", "done") })
+
+	s := &systemd{c: &config{Name: "svc"}}
+	fellBack := false
+	err := withSystemBus(func(conn *busConn) error {
+		return conn.runJob("StartUnit", "svc.service")
+	}, func() error {
+		fellBack = true
+		return nil
+	})
+	if err != nil || fellBack {
+		t.Fatalf("runJob = %v, fell back to systemctl: %v", err, fellBack)
+	}
+	want := []string{
+		"Hello /org/freedesktop/DBus",
+		"AddMatch /org/freedesktop/DBus " + jobRemovedMatch,
+		"Subscribe " + systemdPath,
+		"StartUnit " + systemdPath + " svc.service replace",
+	}
+	if calls := bus.takeCalls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls\n%q\nwant\n%q", calls, want)
+	}
+
+	// the unit has failed once the start job is done
+	if err = s.runJob("StartUnit", "start", "svc.service"); !errors.Is(err, errUnitFailed) {
+		t.Errorf("runJob of a failed unit = %v, want %v", err, errUnitFailed)
+	}
+	// stopping doesn't check the state
+	if err = s.runJob("StopUnit", "stop", "svc.service"); err != nil {
+		t.Errorf("runJob StopUnit = %v", err)
+	}
+
+	// any result but done fails the job, systemctl isn't run again
+	for _, result := range []string{"failed", "canceled", "timeout", "dependency", "skipped"} {
+		bus.handle("StopUnit", func(*busCall) busReply { return jobRemoved(job, "svc.service", result) })
+		fellBack = false
+		err = withSystemBus(func(conn *busConn) error {
+			return conn.runJob("StopUnit", "svc.service")
+		}, func() error {
+			fellBack = true
+			return nil
+		})
+		if !errors.Is(err, errUnitFailed) || fellBack {
+			t.Errorf("runJob of a %s job = %v, fell back to systemctl: %v", result, err, fellBack)
+		}
+	}
+}
+
+func TestBusEnableUnitFiles(t *testing.T) {
+	bus := listenFakeBus(t)
+	bus.handle("EnableUnitFiles", func(*busCall) busReply {
+		// carries_install_info and the empty a(sss) of the changes
+		return busReply{signature: "ba(sss)", encode: func(e *busEncoder) {
+			_ = e.value("b", true)
+			e.uint32(0)
+			e.align(8)
+		}}
+	})
+	bus.handle("DisableUnitFiles", func(*busCall) busReply {
+		return busReply{signature: "a(sss)", encode: func(e *busEncoder) {
+			e.uint32(0)
+			e.align(8)
+		}}
+	})
+	bus.handle("Reload", func(*busCall) busReply { return busReply{} })
+	conn := dialFakeBus(t)
+
+	if err := conn.enableUnitFiles("svc.service", "svc.socket"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.disableUnitFiles("svc.service"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Hello /org/freedesktop/DBus",
+		"EnableUnitFiles " + systemdPath + " [svc.service svc.socket] false false",
+		"Reload " + systemdPath,
+		"DisableUnitFiles " + systemdPath + " [svc.service] false",
+		"Reload " + systemdPath,
+	}
+	if calls := bus.takeCalls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls\n%q\nwant\n%q", calls, want)
+	}
+}
+
+func TestBusErrorReply(t *testing.T) {
+	bus := listenFakeBus(t)
+	bus.handle("GetUnitFileState", func(call *busCall) busReply {
+		return busErrorOf("org.freedesktop.DBus.Error.FileNotFound", "No such file or directory")
+	})
+
+	// systemd has answered, so systemctl isn't run instead
+	fellBack := false
+	err := withSystemBus(func(conn *busConn) error {
+		_, err := conn.unitFileState("svc@a.service")
+		return err
+	}, func() error {
+		fellBack = true
+		return nil
+	})
+	var reply *busErrorReply
+	if !errors.As(err, &reply) || reply.Name != "org.freedesktop.DBus.Error.FileNotFound" || reply.Message != "No such file or directory" {
+		t.Errorf("withSystemBus = %v, want the error reply", err)
+	}
+	if fellBack || isBusUnreachable(err) {
+		t.Errorf("the error reply %v fell back to systemctl", err)
+	}
+}
+
+func TestBusMalformedReply(t *testing.T) {
+	bus := listenFakeBus(t)
+	for _, member := range []string{"LoadUnit", "GetUnitFileState", "StartUnit"} {
+		bus.handle(member, func(*busCall) busReply { return busReply{} })
+	}
+	conn := dialFakeBus(t)
+
+	if _, err := conn.unitProperties("svc.service"); !errors.Is(err, errBusMessage) {
+		t.Errorf("unitProperties of an empty reply = %v, want %v", err, errBusMessage)
+	}
+	if _, err := conn.unitFileState("svc.service"); !errors.Is(err, errBusMessage) {
+		t.Errorf("unitFileState of an empty reply = %v, want %v", err, errBusMessage)
+	}
+	if err := conn.runJob("StartUnit", "svc.service"); !errors.Is(err, errBusMessage) {
+		t.Errorf("runJob of an empty reply = %v, want %v", err, errBusMessage)
+	}
+}
+
+func TestBusDecoderLimits(t *testing.T) {
+	// a dictionary entry with three values
+	e := &busEncoder{order: binary.LittleEndian}
+	e.uint32(0)
+	e.align(8)
+	for _, v := range []string{"a", "b", "c"} {
+		if err := e.value("s", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.order.PutUint32(e.buf.Bytes(), uint32(e.buf.Len()-8))
+	d := &busDecoder{order: binary.LittleEndian, data: e.buf.Bytes()}
+	if _, err := d.value("a{sss}"); !errors.Is(err, errBusMessage) {
+		t.Errorf("dictionary entry of three values = %v, want %v", err, errBusMessage)
+	}
+
+	// variants holding variants, each one is the signature "v" followed by the next one
+	nested := func(n int) []byte {
+		return []byte(strings.Repeat("\x01v\x00", n) + "\x01y\x00\x07")
+	}
+	d = &busDecoder{order: binary.LittleEndian, data: nested(10)}
+	if v, err := d.value("v"); err != nil || v != byte(7) {
+		t.Errorf("10 nested variants = %v, %v, want 7", v, err)
+	}
+	d = &busDecoder{order: binary.LittleEndian, data: nested(maxBusDepth)}
+	if _, err := d.value("v"); !errors.Is(err, errBusMessage) {
+		t.Errorf("%d nested variants = %v, want %v", maxBusDepth, err, errBusMessage)
+	}
+}
+
+func TestWithSystemBusFallback(t *testing.T) {
+	fallback := func(fellBack *bool) func() error {
+		return func() error {
+			*fellBack = true
+			return nil
+		}
+	}
+	op := func(conn *busConn) error {
+		_, err := conn.unitFileState("svc.service")
+		return err
+	}
+
+	// nothing listens on the socket
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "missing"))
+	fellBack := false
+	if err := withSystemBus(op, fallback(&fellBack)); err != nil || !fellBack {
+		t.Errorf("no bus: withSystemBus = %v, fell back: %v", err, fellBack)
+	}
+
+	// the address has no unix socket
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "tcp:host=localhost,port=1")
+	fellBack = false
+	if err := withSystemBus(op, fallback(&fellBack)); err != nil || !fellBack {
+		t.Errorf("tcp address: withSystemBus = %v, fell back: %v", err, fellBack)
+	}
+
+	// the bus rejects the authentication
+	bus := listenFakeBus(t)
+	bus.mu.Lock()
+	bus.reject = true
+	bus.mu.Unlock()
+	if _, err := dialSystemBus(); !errors.Is(err, errBusAuth) {
+		t.Errorf("dialSystemBus = %v, want %v", err, errBusAuth)
+	}
+	fellBack = false
+	if err := withSystemBus(op, fallback(&fellBack)); err != nil || !fellBack {
+		t.Errorf("rejected: withSystemBus = %v, fell back: %v", err, fellBack)
+	}
+
+	// the bus goes away while the connection is set up
+	bus = listenFakeBus(t)
+	bus.handle("Hello", func(*busCall) busReply { return busReply{drop: true} })
+	fellBack = false
+	if err := withSystemBus(op, fallback(&fellBack)); err != nil || !fellBack {
+		t.Errorf("dropped hello: withSystemBus = %v, fell back: %v", err, fellBack)
+	}
+
+	// the bus goes away once the call is written, systemd may have run it already
+	bus = listenFakeBus(t)
+	bus.handle("StartUnit", func(*busCall) busReply { return busReply{drop: true} })
+	fellBack = false
+	err := withSystemBus(func(conn *busConn) error {
+		return conn.runJob("StartUnit", "svc.service")
+	}, fallback(&fellBack))
+	if !errors.Is(err, io.EOF) || fellBack {
+		t.Errorf("dropped call: withSystemBus = %v, fell back: %v", err, fellBack)
+	}
+}
@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"errors"
+	"strings"
+)
+
+// errUnknownDepKind appears if a dependency has a kind other than the DepKind constants
+var errUnknownDepKind = errors.New("unknown dependency kind, expect requires, wants, after, before or binds_to")
+
+// DepKind is how a service relates to its dependency, named after the systemd settings
+type DepKind string
+
+const (
+	Requires DepKind = "requires" // fail if the dependency can't be started
+	Wants    DepKind = "wants"    // start the dependency but don't fail without it
+	After    DepKind = "after"    // start after the dependency, stop before it
+	Before   DepKind = "before"   // start before the dependency, stop after it
+	BindsTo  DepKind = "binds_to" // like Requires, and stop when the dependency stops
+)
+
+// the abstract targets which each backend translates into its own names,
+// they are the LSB facilities which systemv uses as they are
+const (
+	Network     = "$network"
+	Time        = "$time"
+	Filesystem  = "$local_fs"
+	NameService = "$named"
+)
+
+// systemdTargets are the systemd units of the abstract targets
+var systemdTargets = map[string]string{
+	Network:     "network-online.target",
+	Time:        "time-sync.target",
+	Filesystem:  "local-fs.target",
+	NameService: "nss-lookup.target",
+}
+
+// Dep is a dependency of the service, Name is an abstract target such as Network or the name of another service.
+// The zero Kind means both Requires and After, which is what a dependency usually needs.
+type Dep struct {
+	Name string  `json:"name" yaml:"name" toml:"name"`
+	Kind DepKind `json:"kind" yaml:"kind" toml:"kind"`
+}
+
+// defaultDeps are required by every service, the dependencies set by the options are added to them
+var defaultDeps = []Dep{{Name: Network}, {Name: Time}, {Name: Filesystem}, {Name: NameService}}
+
+// WithDependency adds the dependencies to the default ones, which are Network, Time, Filesystem and NameService
+func WithDependency(deps ...Dep) Configurator {
+	return Option(func(c *config) {
+		c.Deps = append(c.Deps, deps...)
+	})
+}
+
+func validateDep(d Dep) error {
+	switch d.Kind {
+	case "", Requires, Wants, After, Before, BindsTo:
+	default:
+		return errUnknownDepKind
+	}
+	if !validDependency.MatchString(d.Name) {
+		return errInvalidName
+	}
+	return nil
+}
+
+// deps returns all the dependencies with the empty kinds expanded to Requires and After.
+// The raw Dependencies string replaces the defaults as it always has.
+func (c *config) deps() []Dep {
+	var all []Dep
+	if c.Dependencies == "" {
+		all = append(all, defaultDeps...)
+	}
+	all = append(all, c.Deps...)
+	// the members of a group which must be started first
+	for _, name := range c.Requires {
+		all = append(all, Dep{Name: name})
+	}
+	expanded := make([]Dep, 0, len(all)*2)
+	for _, d := range all {
+		if d.Kind == "" {
+			expanded = append(expanded, Dep{Name: d.Name, Kind: Requires}, Dep{Name: d.Name, Kind: After})
+			continue
+		}
+		expanded = append(expanded, d)
+	}
+	return expanded
+}
+
+// depSetting is a line of dependencies in a service file
+type depSetting struct {
+	Directive string
+	Names     string
+}
+
+// depNames returns the names of the dependencies of the kinds translated by name without duplicates
+func (c *config) depNames(name func(string) string, kinds ...DepKind) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, d := range c.deps() {
+		for _, kind := range kinds {
+			if d.Kind != kind {
+				continue
+			}
+			n := name(d.Name)
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	return names
+}
+
+// systemdDeps returns the dependency settings of the unit, the raw Dependencies string is
+// added as it is to Requires= and After=
+func systemdDeps(c *config) []depSetting {
+	var settings []depSetting
+	for _, s := range []struct {
+		directive string
+		kind      DepKind
+	}{
+		{"Requires", Requires},
+		{"Wants", Wants},
+		{"BindsTo", BindsTo},
+		{"After", After},
+		{"Before", Before},
+	} {
+		names := c.depNames(systemdUnit, s.kind)
+		if c.Dependencies != "" && (s.kind == Requires || s.kind == After) {
+			names = append(strings.Fields(c.Dependencies), names...)
+		}
+		if len(names) > 0 {
+			settings = append(settings, depSetting{Directive: s.directive, Names: strings.Join(names, " ")})
+		}
+	}
+	return settings
+}
+
+// systemdUnit translates a dependency into a unit name, the services without a unit suffix are .service units
+func systemdUnit(name string) string {
+	if unit, ok := systemdTargets[name]; ok {
+		return unit
+	}
+	if strings.HasPrefix(name, "$") {
+		// an LSB facility without a systemd counterpart
+		return strings.TrimPrefix(name, "$") + ".target"
+	}
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// lsbDeps returns the LSB header lines of the init script, the raw Dependencies string is
+// added as it is to Required-Start and Required-Stop
+func lsbDeps(c *config) []depSetting {
+	var settings []depSetting
+	// a required dependency is already started first, so it's left out of the weaker lines
+	required := make(map[string]bool)
+	for _, s := range []struct {
+		directives []string
+		kinds      []DepKind
+	}{
+		{[]string{"Required-Start", "Required-Stop"}, []DepKind{Requires, BindsTo}},
+		{[]string{"Should-Start", "Should-Stop"}, []DepKind{Wants, After}},
+		{[]string{"X-Start-Before", "X-Stop-After"}, []DepKind{Before}},
+	} {
+		var names []string
+		if c.Dependencies != "" && s.kinds[0] == Requires {
+			names = strings.Fields(c.Dependencies)
+		}
+		for _, name := range c.depNames(lsbName, s.kinds...) {
+			if !required[name] {
+				names = append(names, name)
+			}
+		}
+		if s.kinds[0] == Requires {
+			for _, name := range names {
+				required[name] = true
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		for _, directive := range s.directives {
+			settings = append(settings, depSetting{Directive: directive, Names: strings.Join(names, " ")})
+		}
+	}
+	return settings
+}
+
+// lsbName translates a dependency into the name of an init script or a facility
+func lsbName(name string) string {
+	for facility, unit := range systemdTargets {
+		if name == unit {
+			return facility
+		}
+	}
+	return strings.TrimSuffix(name, ".service")
+}
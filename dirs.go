@@ -0,0 +1,260 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the base directories of the managed directories, the same as systemd uses for the system services
+const (
+	stateBaseDir   = "/var/lib"
+	cacheBaseDir   = "/var/cache"
+	runtimeBaseDir = "/run"
+	logsBaseDir    = "/var/log"
+	configBaseDir  = "/etc"
+)
+
+// errInvalidDirectory appears if a managed directory is not a relative path inside its base directory
+var errInvalidDirectory = errors.New("must be a relative path without ..")
+
+// Dirs are the directories managed for the service, each one is a path relative to its base directory,
+// e.g. State "myapp" is /var/lib/myapp. Empty ones are not managed.
+type Dirs struct {
+	State   string `json:"state" yaml:"state" toml:"state"`       // under /var/lib, owned by the service's user
+	Cache   string `json:"cache" yaml:"cache" toml:"cache"`       // under /var/cache, owned by the service's user
+	Runtime string `json:"runtime" yaml:"runtime" toml:"runtime"` // under /run, owned by the service's user and recreated on start
+	Logs    string `json:"logs" yaml:"logs" toml:"logs"`          // under /var/log, owned by the service's user
+	Config  string `json:"config" yaml:"config" toml:"config"`    // under /etc, owned by root
+}
+
+// RemoveOptions changes what Remove deletes besides the service files
+type RemoveOptions struct {
+	Purge bool // delete the managed directories created by Install as well, the ones which existed before are kept
+}
+
+// Remover is implemented by the daemons which can be removed with options, all the built-in backends do
+type Remover interface {
+	RemoveWith(opts RemoveOptions) error
+}
+
+// WithDirectories manages the directories of the service. Systemd creates them from the
+// StateDirectory=, CacheDirectory=, RuntimeDirectory=, LogsDirectory= and ConfigurationDirectory= settings,
+// the other backends create them on Install and the runtime one on Start as well.
+// The absolute paths are passed to the service in the same environment variables as systemd does,
+// e.g. STATE_DIRECTORY.
+func WithDirectories(dirs Dirs) Configurator {
+	return Option(func(c *config) {
+		c.Directories = dirs
+	})
+}
+
+// managedDir is a directory set by WithDirectories
+type managedDir struct {
+	field     string // the field of Dirs
+	directive string // the systemd setting, also the prefix of the environment variable
+	base      string
+	name      string
+	rootOwned bool
+	runtime   bool // lost on reboot, so created on start
+}
+
+func (d managedDir) path() string {
+	return filepath.Join(d.base, d.name)
+}
+
+// env is the environment variable which holds the path of the directory
+func (d managedDir) env() string {
+	return strings.ToUpper(strings.TrimSuffix(d.directive, "Directory")) + "_DIRECTORY"
+}
+
+func (c *config) managedDirs() []managedDir {
+	all := []managedDir{
+		{field: "State", directive: "StateDirectory", base: stateBaseDir, name: c.Directories.State},
+		{field: "Cache", directive: "CacheDirectory", base: cacheBaseDir, name: c.Directories.Cache},
+		{field: "Runtime", directive: "RuntimeDirectory", base: runtimeBaseDir, name: c.Directories.Runtime, runtime: true},
+		{field: "Logs", directive: "LogsDirectory", base: logsBaseDir, name: c.Directories.Logs},
+		{field: "Config", directive: "ConfigurationDirectory", base: configBaseDir, name: c.Directories.Config, rootOwned: true},
+	}
+	dirs := make([]managedDir, 0, len(all))
+	for _, d := range all {
+		if d.name != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// validateManagedDir rejects the names which would escape the base directory
+func validateManagedDir(name string) error {
+	if filepath.IsAbs(name) || filepath.Clean(name) == "." {
+		return errInvalidDirectory
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return errInvalidDirectory
+		}
+	}
+	return nil
+}
+
+// createdDirsPath is where the directories created for the service are recorded,
+// so Remove never purges a directory which existed before Install, e.g. one shared with other services
+func createdDirsPath(name string) string {
+	return "/var/lib/daemon/" + name + ".dirs"
+}
+
+// createDirs creates the missing managed directories owned by the service's user, only the runtime ones if runtime is true.
+// The directories created on Install are recorded for Remove.
+func createDirs(c *config, runtime bool) error {
+	dirs := c.managedDirs()
+	if len(dirs) == 0 {
+		return nil
+	}
+	uid, gid, err := lookupOwner(c.User, c.Group)
+	if err != nil {
+		return err
+	}
+	var record []string
+	for _, d := range dirs {
+		if runtime && !d.runtime {
+			continue
+		}
+		owner, group := uid, gid
+		if d.rootOwned {
+			owner, group = 0, 0
+		}
+		// the existing directories keep their owner, so a directory shared with other services is never taken over
+		created, err := mkdirOwned(d.path(), 0755, owner, group)
+		for _, dir := range created {
+			if insideDir(dir, d.base) {
+				record = append(record, dir)
+				break
+			}
+		}
+		if err != nil {
+			if !runtime {
+				_ = recordDirs(c, record)
+			}
+			return err
+		}
+	}
+	if runtime {
+		return nil
+	}
+	return recordDirs(c, record)
+}
+
+// missingDirs returns the outermost missing directory of each managed directory, which systemd creates on start,
+// the directories of dynamic users are kept under private
+func missingDirs(c *config) []string {
+	var missing []string
+	add := func(dir, base string) {
+		outermost := ""
+		for p := dir; insideDir(p, base) && !pathOrFileIsExist(p); p = filepath.Dir(p) {
+			outermost = p
+		}
+		if outermost != "" {
+			missing = append(missing, outermost)
+		}
+	}
+	for _, d := range c.managedDirs() {
+		add(d.path(), d.base)
+		if c.dynamicUser() && !d.rootOwned {
+			add(filepath.Join(d.base, "private", d.name), filepath.Join(d.base, "private"))
+		}
+	}
+	return missing
+}
+
+// insideDir reports whether path is below dir, but not dir itself
+func insideDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// recordDirs records the created directories, the record is removed if there are none
+func recordDirs(c *config, dirs []string) error {
+	path := createdDirsPath(c.Name)
+	if len(dirs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(strings.Join(dirs, "\n")+"\n"), 0644)
+}
+
+// removeDirs deletes the recorded directories with all their content if purge is true, and removes the record.
+// Only the directories inside the base of a managed directory which lead to it are deleted,
+// so an edited record can't delete anything else.
+func removeDirs(c *config, purge bool) error {
+	path := createdDirsPath(c.Name)
+	if purge {
+		content, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, dir := range strings.Split(string(content), "\n") {
+			if dir == "" || !ownedDir(c, dir) {
+				continue
+			}
+			if err = os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ownedDir reports whether dir is a managed directory or one of its parents inside the base directory
+func ownedDir(c *config, dir string) bool {
+	for _, d := range c.managedDirs() {
+		bases := []string{d.base}
+		if c.dynamicUser() && !d.rootOwned {
+			bases = append(bases, filepath.Join(d.base, "private"))
+		}
+		for _, base := range bases {
+			managed := filepath.Join(base, d.name)
+			if insideDir(dir, base) && (dir == managed || insideDir(managed, dir)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeWith removes d with the options if it implements Remover, a plain Remove can't honour any option
+func removeWith(d Daemon, opts RemoveOptions) error {
+	if r, ok := d.(Remover); ok {
+		return r.RemoveWith(opts)
+	}
+	if opts != (RemoveOptions{}) {
+		return errUnsupportedOperation
+	}
+	return d.Remove()
+}
+
+// dirSetting is the view of a managed directory used by the templates
+type dirSetting struct {
+	Directive string
+	Name      string
+	Path      string
+	Env       string
+	Runtime   bool
+}
+
+func dirSettings(c *config) []dirSetting {
+	var settings []dirSetting
+	for _, d := range c.managedDirs() {
+		settings = append(settings, dirSetting{Directive: d.directive, Name: d.name, Path: d.path(), Env: d.env(), Runtime: d.runtime})
+	}
+	return settings
+}
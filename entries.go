@@ -0,0 +1,259 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unknownPriority is the priority of the entries whose line doesn't tell the level
+const unknownPriority = -1
+
+// LogEntry is a parsed line of the service's log
+type LogEntry struct {
+	Time     time.Time // when the line was logged, zero if the line has no timestamp
+	Priority int       // the syslog priority from 0 (emerg) to 7 (debug), -1 if unknown
+	PID      int       // the pid of the logging process, 0 if unknown
+	Unit     string    // the name of the service
+	Message  string
+}
+
+// LogEntryReader is implemented by the daemons which can stream their log as parsed entries,
+// all the built-in backends do. The channel is closed once the log ends or ctx is done.
+type LogEntryReader interface {
+	LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error)
+}
+
+// syslogPriorities maps the level names used by common loggers to syslog priorities
+var syslogPriorities = map[string]int{
+	"emerg": 0, "emergency": 0, "panic": 0,
+	"alert": 1,
+	"crit":  2, "critical": 2, "fatal": 2,
+	"err": 3, "error": 3,
+	"warn": 4, "warning": 4,
+	"notice": 5,
+	"info":   6, "information": 6,
+	"debug": 7, "trace": 7,
+}
+
+// lineTimeLayouts are the timestamp prefixes recognized in plain text lines
+var lineTimeLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.000000",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05.000000",
+	"2006/01/02 15:04:05",
+	time.Stamp,
+}
+
+// journalEntries streams the journal of the unit in JSON format and parses each line into a LogEntry,
+// match selects the entries of the unit, by "-u unit" if it's empty
+func journalEntries(ctx context.Context, unit string, opts LogOptions, match ...string) (<-chan LogEntry, error) {
+	if len(match) == 0 {
+		match = []string{"-u", unit}
+	}
+	args := append(append(match, "-o", "json"), opts.journalArgs()...)
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	entries := make(chan LogEntry)
+	go func() {
+		defer close(entries)
+		defer func() {
+			_ = cmd.Wait()
+		}()
+		scanner := bufio.NewScanner(out)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			entry, ok := parseJournalEntry(scanner.Bytes(), unit)
+			if !ok {
+				continue
+			}
+			select {
+			case entries <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return entries, nil
+}
+
+func parseJournalEntry(line []byte, unit string) (LogEntry, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return LogEntry{}, false
+	}
+	entry := LogEntry{Priority: unknownPriority, Unit: unit}
+	if us, err := strconv.ParseInt(journalString(fields["__REALTIME_TIMESTAMP"]), 10, 64); err == nil {
+		entry.Time = time.Unix(0, us*int64(time.Microsecond))
+	}
+	if p, err := strconv.Atoi(journalString(fields["PRIORITY"])); err == nil {
+		entry.Priority = p
+	}
+	if pid, err := strconv.Atoi(journalString(fields["_PID"])); err == nil {
+		entry.PID = pid
+	}
+	if u := journalString(fields["_SYSTEMD_UNIT"]); u != "" {
+		entry.Unit = u
+	}
+	entry.Message = journalString(fields["MESSAGE"])
+	return entry, true
+}
+
+// journalString converts a journal field into a string,
+// fields which are not valid UTF-8 are exported by journalctl as arrays of bytes
+func journalString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case []interface{}:
+		b := make([]byte, 0, len(value))
+		for _, c := range value {
+			if n, ok := c.(float64); ok {
+				b = append(b, byte(n))
+			}
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// lineEntries parses the plain log written by logs into LogEntry,
+// Since and Until are applied to the timestamps found in the lines because the underlying log can't filter by time
+func lineEntries(ctx context.Context, unit string, opts LogOptions, logs func(ctx context.Context, opts LogOptions) error) (<-chan LogEntry, error) {
+	since, until := opts.Since, opts.Until
+	opts.Since, opts.Until = time.Time{}, time.Time{}
+	pr, pw := io.Pipe()
+	opts.Writer = pw
+	go func() {
+		_ = pw.CloseWithError(logs(ctx, opts))
+	}()
+
+	entries := make(chan LogEntry)
+	go func() {
+		defer close(entries)
+		defer func() {
+			_ = pr.Close()
+		}()
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			entry := parseLogLine(scanner.Text(), unit)
+			if !entry.Time.IsZero() && (!since.IsZero() && entry.Time.Before(since) || !until.IsZero() && entry.Time.After(until)) {
+				continue
+			}
+			select {
+			case entries <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return entries, nil
+}
+
+// parseLogLine parses a JSON line written by a structured logger or a plain text line with an optional timestamp and level
+func parseLogLine(line, unit string) LogEntry {
+	entry := LogEntry{Priority: unknownPriority, Unit: unit, Message: line}
+	if strings.HasPrefix(strings.TrimSpace(line), "{") && parseJSONLine(line, &entry) {
+		return entry
+	}
+
+	rest := line
+	for _, layout := range lineTimeLayouts {
+		var prefix string
+		if strings.Contains(layout, "Z07:00") {
+			// RFC3339 timestamps have variable length, they end at the first space
+			prefix = strings.SplitN(line, " ", 2)[0]
+		} else if len(line) >= len(layout) {
+			prefix = line[:len(layout)]
+		} else {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, prefix, time.Local); err == nil {
+			if t.Year() == 0 {
+				t = t.AddDate(time.Now().Year(), 0, 0)
+			}
+			entry.Time = t
+			rest = strings.TrimLeft(line[len(prefix):], " ")
+			break
+		}
+	}
+
+	// a level is often the first word after the timestamp, e.g. "[ERROR]", "WARN:" or "level=info"
+	word := strings.SplitN(rest, " ", 2)[0]
+	word = strings.TrimPrefix(strings.ToLower(strings.Trim(word, "[]<>:")), "level=")
+	if p, ok := syslogPriorities[word]; ok {
+		entry.Priority = p
+	}
+	entry.Message = rest
+	return entry
+}
+
+func parseJSONLine(line string, entry *LogEntry) bool {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return false
+	}
+	for _, key := range []string{"time", "ts", "timestamp", "@timestamp"} {
+		if t, ok := jsonTime(fields[key]); ok {
+			entry.Time = t
+			break
+		}
+	}
+	for _, key := range []string{"level", "severity", "priority"} {
+		if p, ok := jsonPriority(fields[key]); ok {
+			entry.Priority = p
+			break
+		}
+	}
+	for _, key := range []string{"msg", "message"} {
+		if v, ok := fields[key].(string); ok {
+			entry.Message = v
+			break
+		}
+	}
+	if v, ok := fields["pid"].(float64); ok {
+		entry.PID = int(v)
+	}
+	return true
+}
+
+// jsonTime accepts RFC3339 strings and unix timestamps in seconds
+func jsonTime(v interface{}) (time.Time, bool) {
+	switch value := v.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true
+		}
+	case float64:
+		sec := int64(value)
+		return time.Unix(sec, int64((value-float64(sec))*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+// jsonPriority accepts level names and syslog priorities
+func jsonPriority(v interface{}) (int, bool) {
+	switch value := v.(type) {
+	case string:
+		p, ok := syslogPriorities[strings.ToLower(value)]
+		return p, ok
+	case float64:
+		return int(value), true
+	}
+	return 0, false
+}
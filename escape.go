@@ -0,0 +1,289 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// errControlCharacter appears if a value contains a newline or another control character,
+	// which would start a new directive in any of the service files
+	errControlCharacter = errors.New("control characters are not allowed")
+
+	// errUnterminatedQuote appears if the arguments have an unterminated quote
+	errUnterminatedQuote = errors.New("unterminated quote")
+
+	// errUnsafeValue appears if a value can't be represented in a service file
+	errUnsafeValue = errors.New("the value can't be written safely")
+)
+
+// checkControl rejects the control characters, tabs are allowed
+func checkControl(value string) error {
+	for _, r := range value {
+		if (r < 0x20 && r != '\t') || r == 0x7f {
+			return errControlCharacter
+		}
+	}
+	return nil
+}
+
+// splitArgs splits the arguments into words like a POSIX shell does with quotes and backslashes,
+// but without any expansion, so "$(cmd)" is a literal word
+func splitArgs(args string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(args); i++ {
+		c := args[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(args) {
+				i++
+				word.WriteByte(args[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(args[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnterminatedQuote
+			}
+			word.WriteString(args[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(args); i++ {
+				if args[i] == '"' {
+					closed = true
+					break
+				}
+				// only these characters are escaped by a backslash in double quotes
+				if args[i] == '\\' && i+1 < len(args) && strings.IndexByte("\"\\$`", args[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(args[i])
+			}
+			if !closed {
+				return nil, errUnterminatedQuote
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// isPlainWord reports whether the word needs no quoting in any of the service files
+func isPlainWord(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_@+=:,./-", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// systemdValue escapes a value of a single line setting in a unit file,
+// % starts a specifier and a trailing backslash continues the line
+func systemdValue(value string) (string, error) {
+	if err := checkControl(value); err != nil {
+		return "", fmt.Errorf("%q: %w", value, err)
+	}
+	if strings.HasSuffix(value, "\\") || strings.TrimSpace(value) != value {
+		return "", fmt.Errorf("%q: %w", value, errUnsafeValue)
+	}
+	return strings.Replace(value, "%", "%%", -1), nil
+}
+
+// systemdExec renders the command line of ExecStart=, each word is quoted if needed,
+// % and $ are doubled so neither specifiers nor environment variables are expanded
+func systemdExec(exec, args string) (string, error) {
+	words, err := commandWords(exec, args)
+	if err != nil {
+		return "", err
+	}
+	return systemdWords(words), nil
+}
+
+// systemdWords quotes the words of a command line for an Exec setting
+func systemdWords(words []string) string {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.Replace(strings.Replace(word, "%", "%%", -1), "$", "$$", -1)
+		if !isPlainWord(word) {
+			word = `"` + strings.Replace(strings.Replace(word, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+		quoted = append(quoted, word)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// iniValue escapes a value in the supervisord config, % starts an expression like %(ENV_HOME)s,
+// and a ; or # after whitespace starts a comment which can't be escaped
+func iniValue(value string) (string, error) {
+	if err := checkControl(value); err != nil {
+		return "", fmt.Errorf("%q: %w", value, err)
+	}
+	for _, comment := range []string{" ;", "\t;", " #", "\t#"} {
+		if strings.Contains(value, comment) {
+			return "", fmt.Errorf("%q: %w", value, errUnsafeValue)
+		}
+	}
+	return strings.Replace(value, "%", "%%", -1), nil
+}
+
+// iniCommand renders the command of a supervisord program, which is split by shlex,
+// so the words are quoted for a POSIX shell
+func iniCommand(exec, args string) (string, error) {
+	words, err := commandWords(exec, args)
+	if err != nil {
+		return "", err
+	}
+	return iniValue(shellJoin(words))
+}
+
+// iniHookCommand renders the command of a supervisord program which runs the hook first,
+// sh only replaces itself with the program if the hook succeeds
+func iniHookCommand(hook, exec, args string) (string, error) {
+	hookLine, err := hookWords(hook)
+	if err != nil {
+		return "", err
+	}
+	words, err := commandWords(exec, args)
+	if err != nil {
+		return "", err
+	}
+	return iniValue("/bin/sh -c " + shellQuote(shellJoin(hookLine)+" && exec "+shellJoin(words)))
+}
+
+// shellJoin quotes the words and joins them into a command line
+func shellJoin(words []string) string {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, shellQuote(word))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes a word for a POSIX shell, the single quotes prevent any expansion
+func shellQuote(word string) string {
+	if isPlainWord(word) {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+// shellValue quotes a value assigned to a variable in the init script
+func shellValue(value string) (string, error) {
+	if err := checkControl(value); err != nil {
+		return "", fmt.Errorf("%q: %w", value, err)
+	}
+	return shellQuote(value), nil
+}
+
+// shellCommand renders the command which is run by sh -c in the init script,
+// it changes into the working directory and passes the environment to the service
+func shellCommand(c *config) (string, error) {
+	line, err := shellCommandLine(c)
+	if err != nil {
+		return "", err
+	}
+	return shellValue(line)
+}
+
+// shellCommandLine is the command of shellCommand before it's quoted as a whole
+func shellCommandLine(c *config) (string, error) {
+	words, err := commandWords(c.Exec, c.Args)
+	if err != nil {
+		return "", err
+	}
+	return shellWords(c, words)
+}
+
+// shellWords quotes the words of a command line which runs in the working directory of the service
+func shellWords(c *config, words []string) (string, error) {
+	if err := checkControl(c.WorkDir); err != nil {
+		return "", fmt.Errorf("%q: %w", c.WorkDir, err)
+	}
+	parts := []string{"cd", shellQuote(c.WorkDir), "&&", "exec", "env"}
+	for _, d := range dirSettings(c) {
+		if err := checkControl(d.Path); err != nil {
+			return "", fmt.Errorf("%q: %w", d.Path, err)
+		}
+		parts = append(parts, shellQuote(d.Env+"="+d.Path))
+	}
+	for _, word := range words {
+		parts = append(parts, shellQuote(word))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// logrotatePath quotes a path in the logrotate config, which has no way to escape a double quote
+func logrotatePath(path string) (string, error) {
+	if err := checkControl(path); err != nil {
+		return "", fmt.Errorf("%q: %w", path, err)
+	}
+	if strings.ContainsAny(path, `"{}`) {
+		return "", fmt.Errorf("%q: %w", path, errUnsafeValue)
+	}
+	return `"` + path + `"`, nil
+}
+
+// commentValue checks a value written into a comment or an LSB header line of the init script,
+// only a newline could end it
+func commentValue(value string) (string, error) {
+	if err := checkControl(value); err != nil {
+		return "", fmt.Errorf("%q: %w", value, err)
+	}
+	return value, nil
+}
+
+// safeName checks a name written where nothing can be quoted, e.g. a section header of the supervisord config
+// or the user field of a crontab line
+func safeName(name string) (string, error) {
+	if !validName.MatchString(name) {
+		return "", fmt.Errorf("%q: %w", name, errInvalidName)
+	}
+	return name, nil
+}
+
+// systemdDir escapes the name of a managed directory, the unit file setting is a list split by whitespace
+func systemdDir(name string) (string, error) {
+	if err := validateManagedDir(name); err != nil {
+		return "", fmt.Errorf("%q: %w", name, err)
+	}
+	if strings.ContainsAny(name, " \t") {
+		return "", fmt.Errorf("%q: %w", name, errUnsafeValue)
+	}
+	return systemdValue(name)
+}
+
+// commandWords returns the executable followed by the arguments split into words
+func commandWords(exec, args string) ([]string, error) {
+	if err := checkControl(exec); err != nil {
+		return nil, fmt.Errorf("%q: %w", exec, err)
+	}
+	if err := checkControl(args); err != nil {
+		return nil, fmt.Errorf("%q: %w", args, err)
+	}
+	words, err := splitArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", args, err)
+	}
+	return append([]string{exec}, words...), nil
+}
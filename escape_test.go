@@ -0,0 +1,310 @@
+package daemon
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// injections are the seeds of the fuzz targets, each one tries to end the value and start something else
+var injections = []string{
+	"plain",
+	"two words",
+	"a\nExecStartPre=/bin/sh -c id",
+	"a\r\nuser=root",
+	"daily\n    postrotate\n        touch /tmp/pwned\n    endscript",
+	"a ;comment",
+	"a #comment",
+	"%h %i %(ENV_HOME)s",
+	"$HOME $(id) `id`",
+	`it's "quoted"`,
+	`trailing\`,
+	"'",
+	`"`,
+	"]\n[program:evil]",
+	"\t tab",
+	"",
+}
+
+func addSeeds(f *testing.F) {
+	for _, s := range injections {
+		f.Add(s)
+	}
+}
+
+func FuzzSplitArgs(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, word string) {
+		words, err := splitArgs(shellQuote(word))
+		if err != nil {
+			t.Fatalf("splitArgs(shellQuote(%q)): %v", word, err)
+		}
+		if len(words) != 1 || words[0] != word {
+			t.Fatalf("splitArgs(shellQuote(%q)) = %q", word, words)
+		}
+
+		// the words of any arguments survive quoting them again
+		words, err = splitArgs(word)
+		if err != nil {
+			return
+		}
+		quoted := make([]string, 0, len(words))
+		for _, w := range words {
+			quoted = append(quoted, shellQuote(w))
+		}
+		again, err := splitArgs(strings.Join(quoted, " "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(words) > 0 && !reflect.DeepEqual(again, words) {
+			t.Fatalf("splitArgs of the quoted %q = %q, want %q", words, again, words)
+		}
+	})
+}
+
+func FuzzSystemdExec(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, args string) {
+		line, err := systemdExec("/usr/bin/svc", args)
+		if err != nil {
+			return
+		}
+		if checkControl(line) != nil {
+			t.Fatalf("systemdExec(%q) = %q starts a new line", args, line)
+		}
+		// neither a specifier nor a variable is left unescaped
+		for _, escaped := range []string{"%%", "$$"} {
+			if strings.Contains(strings.Replace(line, escaped, "", -1), escaped[:1]) {
+				t.Fatalf("systemdExec(%q) = %q has an unescaped %s", args, line, escaped[:1])
+			}
+		}
+	})
+}
+
+func FuzzIniCommand(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, args string) {
+		line, err := iniCommand("/usr/bin/svc", args)
+		if err != nil {
+			return
+		}
+		if checkControl(line) != nil {
+			t.Fatalf("iniCommand(%q) = %q starts a new line", args, line)
+		}
+		for _, comment := range []string{" ;", "\t;", " #", "\t#"} {
+			if strings.Contains(line, comment) {
+				t.Fatalf("iniCommand(%q) = %q starts a comment", args, line)
+			}
+		}
+		// supervisord expands %% and splits the command like a shell
+		want, _ := commandWords("/usr/bin/svc", args)
+		words, err := splitArgs(strings.Replace(line, "%%", "%", -1))
+		if err != nil || !reflect.DeepEqual(words, want) {
+			t.Fatalf("iniCommand(%q) = %q is split into %q, want %q", args, line, words, want)
+		}
+	})
+}
+
+func FuzzIniHookCommand(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		hook := "/usr/bin/hook " + shellQuote(value)
+		line, err := iniHookCommand(hook, "/usr/bin/svc", "--name "+shellQuote(value))
+		if err != nil {
+			return
+		}
+		if checkControl(line) != nil {
+			t.Fatalf("iniHookCommand(%q) = %q starts a new line", value, line)
+		}
+		// supervisord passes a single command line to sh -c, which runs the hook before the program
+		words, err := splitArgs(strings.Replace(line, "%%", "%", -1))
+		if err != nil || len(words) != 3 || words[0] != "/bin/sh" || words[1] != "-c" {
+			t.Fatalf("iniHookCommand(%q) = %q is split into %q", value, line, words)
+		}
+		script, err := splitArgs(words[2])
+		want := []string{"/usr/bin/hook", value, "&&", "exec", "/usr/bin/svc", "--name", value}
+		if err != nil || !reflect.DeepEqual(script, want) {
+			t.Fatalf("iniHookCommand(%q) runs %q, want %q", value, script, want)
+		}
+	})
+}
+
+func FuzzShellCommand(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		c := &config{Exec: "/usr/bin/svc", Args: "--name " + shellQuote(value), WorkDir: "/srv/" + value}
+		quoted, err := shellCommand(c)
+		if err != nil {
+			return
+		}
+		if checkControl(quoted) != nil {
+			t.Fatalf("shellCommand(%q) = %q starts a new line", value, quoted)
+		}
+		// the init script passes the quoted command to sh -c as a single word
+		line, err := splitArgs(quoted)
+		if err != nil || len(line) != 1 {
+			t.Fatalf("shellCommand(%q) = %q is not a single word", value, quoted)
+		}
+		words, err := splitArgs(line[0])
+		want := []string{"cd", c.WorkDir, "&&", "exec", "env", c.Exec, "--name", value}
+		if err != nil || !reflect.DeepEqual(words, want) {
+			t.Fatalf("shellCommand(%q) runs %q, want %q", value, words, want)
+		}
+	})
+}
+
+// renderMarker stands for the fuzzed value in the baseline rendering
+const renderMarker = "VALUE"
+
+// renderFields set a fuzzed value into the config, each one keeps the value in the same place
+// as renderMarker does
+var renderFields = map[string]func(c *config, value string){
+	"Name":        func(c *config, value string) { c.Name = value },
+	"Description": func(c *config, value string) { c.Description = value },
+	"Exec":        func(c *config, value string) { c.Exec = "/usr/bin/" + value },
+	"Args":        func(c *config, value string) { c.Args = "--name " + shellQuote(value) },
+	"WorkDir":     func(c *config, value string) { c.WorkDir = "/srv/" + value },
+	"User":        func(c *config, value string) { c.User = value },
+	"Group":       func(c *config, value string) { c.Group = value },
+	"LogFile": func(c *config, value string) {
+		c.LogFile = "/var/log/" + value + ".log"
+		if c.LogOutput.kind == fileOutput {
+			c.LogOutput = File(c.LogFile)
+		}
+	},
+	"StderrLogFile": func(c *config, value string) { c.StderrLogFile = "/var/log/" + value + ".err" },
+	"Hooks":         func(c *config, value string) { c.Hooks.PreStart = "/usr/bin/hook " + shellQuote(value) },
+	"Directories":   func(c *config, value string) { c.Directories.State = value },
+}
+
+// renderBackends render the variants of the service files which the values go into
+var renderBackends = map[string]func(c *config) Renderer{
+	"systemd": func(c *config) Renderer { return &systemd{c: c} },
+	"systemd-syslog": func(c *config) Renderer {
+		c.LogOutput = Syslog("local0")
+		return &systemd{c: c}
+	},
+	"systemd-timer": func(c *config) Renderer {
+		c.Schedule = &Schedule{OnCalendar: "daily"}
+		return &systemd{c: c}
+	},
+	"systemd-socket": func(c *config) Renderer {
+		c.Sockets = []Listen{{Type: Stream, Address: "127.0.0.1:8080"}}
+		return &systemd{c: c}
+	},
+	"systemv":        func(c *config) Renderer { return &systemv{c: c} },
+	"systemv-syslog": func(c *config) Renderer { c.LogOutput = Syslog("local0"); return &systemv{c: c} },
+	"supervisord":    func(c *config) Renderer { return &supervisord{c: c} },
+	"cron": func(c *config) Renderer {
+		c.Schedule = &Schedule{OnCalendar: "daily"}
+		return &cronJob{c: c}
+	},
+}
+
+// renderWith renders the files of the backend with the value set into the field
+func renderWith(backend, field, value string) ([]Artifact, error) {
+	c := &config{
+		Name:        "svc",
+		Description: "the service",
+		Exec:        "/usr/bin/svc",
+		Args:        "--port 8080",
+		WorkDir:     "/srv/svc",
+		User:        "svc",
+		Group:       "svc",
+		LogFile:     "/var/log/svc.log",
+		LogOutput:   File("/var/log/svc.log"),
+		Rotation:    defaultRotation(),
+	}
+	newBackend := renderBackends[backend]
+	d := newBackend(c)
+	renderFields[field](c, value)
+	if err := setupConfig(c); err != nil {
+		return nil, err
+	}
+	return d.Render()
+}
+
+// checkRendered checks that the value stays where the marker is in the baseline, it can neither add a line
+// nor change anything before the word it's written into
+func checkRendered(t *testing.T, baseline, files []Artifact) {
+	t.Helper()
+	if len(files) != len(baseline) {
+		t.Fatalf("rendered %d files, want %d", len(files), len(baseline))
+	}
+	for i, f := range files {
+		want := strings.Split(string(baseline[i].Content), "\n")
+		got := strings.Split(string(f.Content), "\n")
+		if len(got) != len(want) {
+			t.Fatalf("%s has %d lines, want %d:\n%s", f.Path, len(got), len(want), f.Content)
+		}
+		for j, line := range want {
+			at := strings.Index(line, renderMarker)
+			if at < 0 {
+				if got[j] != line {
+					t.Fatalf("%s line %d is %q, want %q", f.Path, j+1, got[j], line)
+				}
+				continue
+			}
+			// the quotes of the word may change, the setting and the words before it may not
+			cut := strings.LastIndex(line[:at], " ")
+			if cut < 0 {
+				cut = strings.LastIndexAny(line[:at], "=:")
+			}
+			prefix := line[:cut+1]
+			if !strings.HasPrefix(got[j], prefix) {
+				t.Fatalf("%s line %d is %q, want the prefix %q", f.Path, j+1, got[j], prefix)
+			}
+		}
+	}
+}
+
+func FuzzRender(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, value string) {
+		if value == "" || strings.Contains(value, renderMarker) {
+			return
+		}
+		for backend := range renderBackends {
+			for field := range renderFields {
+				baseline, err := renderWith(backend, field, renderMarker)
+				if err != nil {
+					t.Fatalf("%s %s: %v", backend, field, err)
+				}
+				files, err := renderWith(backend, field, value)
+				if err != nil {
+					continue
+				}
+				checkRendered(t, baseline, files)
+			}
+		}
+	})
+}
+
+func TestRotationInjection(t *testing.T) {
+	for _, r := range []Rotation{
+		{Period: "daily\n    postrotate\n        touch /tmp/pwned\n    endscript", Keep: 10},
+		{Period: "hourly", Keep: 10},
+		{Period: Daily, Keep: -1},
+		{Period: Daily, Keep: 10, MaxSize: -1},
+	} {
+		err := Validate(WithExec("/bin/sh"), WithName("svc"), WithLogRotation(r))
+		var ve ValidationError
+		if !errors.As(err, &ve) {
+			t.Fatalf("Validate(%+v) = %v, want a ValidationError", r, err)
+		}
+		found := false
+		for _, fe := range ve {
+			found = found || strings.HasPrefix(fe.Field, "Rotation.")
+		}
+		if !found {
+			t.Errorf("Validate(%+v) = %v, want a Rotation field error", r, err)
+		}
+
+		// the self wrapping daemon is never validated, so the rendering rejects it as well
+		c := &config{Name: "svc", Rotation: r}
+		if _, err = renderLogRotate(c, true, "/var/log/svc.log"); err == nil {
+			t.Errorf("renderLogRotate(%+v) succeeded", r)
+		}
+	}
+}
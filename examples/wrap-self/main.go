@@ -12,7 +12,6 @@ import (
 
 func main() {
 	if len(os.Args) > 1 {
-		cmd := os.Args[1]
 		d, err := daemon.New(
 			daemon.WithUser("shgsec"),
 			daemon.WithGroup("shgsec"),
@@ -20,60 +19,13 @@ func main() {
 			daemon.WithDescription("test wrapself service"),
 			daemon.WithLockFile("/home/shgsec/wrapself.lock"),
 			daemon.WithPidFile("/home/shgsec/wrapself.pid"),
+			daemon.WithEscalation(daemon.Sudo),
 		)
 		if err != nil {
 			fmt.Println(err)
-			return
+			os.Exit(1)
 		}
-		switch cmd {
-		case "install":
-			if err := d.Install(); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Succeeded")
-			}
-		case "enable":
-			if err := d.Enable(); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Succeeded")
-			}
-		case "disable":
-			if err := d.Disable(); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Succeeded")
-			}
-		case "remove":
-			if err := d.Remove(); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Succeeded")
-			}
-		case "start":
-			if err := d.Start(); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Succeeded")
-			}
-		case "stop":
-			if err := d.Stop(); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Succeeded")
-			}
-		case "status":
-			if err := d.Status(); err != nil {
-				fmt.Println(err)
-			}
-		case "log":
-			if err := d.Log(); err != nil {
-				fmt.Println(err)
-			}
-		default:
-			fmt.Println("Usage: ", os.Args[0], "install|enable|disable|remove|start|stop|status|log")
-		}
-		return
+		os.Exit(daemon.Main(d, os.Args))
 	}
 
 	cp, _ := os.Getwd()
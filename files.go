@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// errUnsafeSymlink appears if a path goes through a symbolic link which may have been planted by another user
+var errUnsafeSymlink = errors.New("refuse to follow a symbolic link which is not owned by root")
+
+// writeFileAtomic replaces the file with the content through a temporary file in the same directory,
+// so a crash leaves either the old or the new file but never a truncated one
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	return writeFileAtomicAs(path, content, mode, -1, -1)
+}
+
+// replaceFile replaces the file like writeFileAtomic and keeps the owner and the mode of fi, the file it replaces
+func replaceFile(path string, content []byte, fi os.FileInfo) error {
+	uid, gid := -1, -1
+	if u, g, ok := fileOwner(fi); ok {
+		uid, gid = int(u), int(g)
+	}
+	return writeFileAtomicAs(path, content, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky), uid, gid)
+}
+
+// writeFileAtomicAs is writeFileAtomic with the owner of the file, -1 keeps the user or the group of the process
+func writeFileAtomicAs(path string, content []byte, mode os.FileMode, uid, gid int) (err error) {
+	if err = checkSymlinks(path); err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(content); err != nil {
+		return err
+	}
+	// the owner is changed first, since chown clears the setuid and setgid bits
+	if uid >= 0 || gid >= 0 {
+		if err = tmp.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	// the temporary file is created with 0600
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the directory entries, so the rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// checkSymlinks rejects the path if it or any of its existing parents is a symbolic link not owned by root,
+// the links owned by root such as /var/run -> /run are followed
+func checkSymlinks(path string) error {
+	path = filepath.Clean(path)
+	for p := path; ; p = filepath.Dir(p) {
+		fi, err := os.Lstat(p)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if uid, _, ok := fileOwner(fi); !ok || uid != 0 {
+				return fmt.Errorf("%s: %w", p, errUnsafeSymlink)
+			}
+		}
+		if p == filepath.Dir(p) {
+			return nil
+		}
+	}
+}
+
+// mkdirOwned creates the directory and its missing parents, only the directories created here
+// are given to uid and gid, the existing ones such as /var/run are never changed.
+// It returns the created directories, the outermost first.
+func mkdirOwned(dir string, mode os.FileMode, uid, gid int) ([]string, error) {
+	if err := checkSymlinks(dir); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for d := filepath.Clean(dir); !pathOrFileIsExist(d); d = filepath.Dir(d) {
+		missing = append([]string{d}, missing...)
+	}
+	created := make([]string, 0, len(missing))
+	for _, d := range missing {
+		if err := os.Mkdir(d, mode); err != nil {
+			return created, err
+		}
+		created = append(created, d)
+		if err := os.Lchown(d, uid, gid); err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
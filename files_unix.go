@@ -0,0 +1,20 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// openNoFollow makes OpenFile fail on a symbolic link
+const openNoFollow = syscall.O_NOFOLLOW
+
+// fileOwner returns the uid and the gid of the file, ok is false if the system doesn't tell them
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
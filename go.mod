@@ -1,3 +1,8 @@
 module github.com/jiashaoying/daemon
 
-go 1.12
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,366 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// errDuplicateMember appears if a daemon is added to a group under a name which is already used
+	errDuplicateMember = errors.New("the name is already used in the group")
+
+	// errUnknownDependency appears if a daemon depends on a name which hasn't been added to the group before it
+	errUnknownDependency = errors.New("the dependency must be added to the group first")
+
+	// errDependencyFailed appears if an operation is skipped because it failed on a daemon which must run first
+	errDependencyFailed = errors.New("skipped because a dependency failed")
+)
+
+// the supervisord priorities of the group members, the lower ones start first and stop last
+const (
+	groupBasePriority = 100
+	groupPriorityStep = 10
+)
+
+// Group manages several daemons which depend on each other. Install and Start run in the order of
+// the dependencies, Stop and Remove in the reverse order, the daemons which don't depend on each other
+// run in parallel.
+// The dependencies are also written into the service files, so the process manager keeps the order on boot:
+// Requires= and After= for systemd, the priority and a group section for supervisord and the LSB headers for systemv.
+type Group struct {
+	name    string
+	members []*groupMember
+	byName  map[string]*groupMember
+}
+
+type groupMember struct {
+	name      string
+	d         Daemon
+	dependsOn []*groupMember
+	depth     int // the length of the longest dependency chain below the member
+}
+
+// MemberError is the error of an operation on a member of a group
+type MemberError struct {
+	Name string
+	Err  error
+}
+
+func (e *MemberError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+func (e *MemberError) Unwrap() error {
+	return e.Err
+}
+
+// GroupError contains the errors of all the failed members in the order they were added
+type GroupError []*MemberError
+
+func (e GroupError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, me := range e {
+		msgs = append(msgs, me.Error())
+	}
+	return "group: " + strings.Join(msgs, "; ")
+}
+
+// NewGroup creates an empty group, the name is used by the process managers which group services, e.g. supervisord
+func NewGroup(name string) (*Group, error) {
+	if !validName.MatchString(name) {
+		return nil, &FieldError{Field: "Group", Value: name, Err: errInvalidName}
+	}
+	return &Group{name: name, byName: make(map[string]*groupMember)}, nil
+}
+
+// Add adds the daemon under the name which the other members refer to in dependsOn,
+// the daemons it depends on must have been added before, so the dependencies can't form a cycle.
+// The group manages a copy of a daemon created by New which has the dependencies, d is left as it is,
+// Daemon returns the copy.
+func (g *Group) Add(name string, d Daemon, dependsOn ...string) error {
+	if _, ok := g.byName[name]; ok {
+		return &MemberError{Name: name, Err: errDuplicateMember}
+	}
+	m := &groupMember{name: name, d: d}
+	for _, dep := range dependsOn {
+		dm, ok := g.byName[dep]
+		if !ok {
+			return &MemberError{Name: dep, Err: errUnknownDependency}
+		}
+		m.dependsOn = append(m.dependsOn, dm)
+		if dm.depth+1 > m.depth {
+			m.depth = dm.depth + 1
+		}
+	}
+
+	if orig := daemonConfig(d); orig != nil {
+		c := *orig
+		c.GroupName = g.name
+		c.Priority = groupBasePriority + groupPriorityStep*m.depth
+		c.Requires = nil
+		for _, dm := range m.dependsOn {
+			if dc := daemonConfig(dm.d); dc != nil {
+				c.Requires = append(c.Requires, dc.serviceName())
+			}
+		}
+		m.d = withConfig(d, &c)
+	}
+	g.members = append(g.members, m)
+	g.byName[name] = m
+	return nil
+}
+
+// Daemon returns the member added under the name, nil if there is none. It's the copy of the daemon passed
+// to Add which has the dependencies of the group if the daemon has been created by New.
+func (g *Group) Daemon(name string) Daemon {
+	if m, ok := g.byName[name]; ok {
+		return m.d
+	}
+	return nil
+}
+
+// Install installs the members after the ones they depend on
+func (g *Group) Install() error {
+	if err := g.run(false, Daemon.Install); err != nil {
+		return err
+	}
+	return g.installGroupSection()
+}
+
+// Start starts the members after the ones they depend on, the running ones are left as they are
+func (g *Group) Start() error {
+	return g.run(false, func(d Daemon) error { return ignoreErr(d.Start(), errAlreadyRunning) })
+}
+
+// Stop stops the members before the ones they depend on, the stopped ones are left as they are
+func (g *Group) Stop() error {
+	return g.run(true, func(d Daemon) error { return ignoreErr(d.Stop(), errAlreadyStopped) })
+}
+
+// Restart stops all the members and starts them again
+func (g *Group) Restart() error {
+	if err := g.Stop(); err != nil {
+		return err
+	}
+	return g.Start()
+}
+
+// Remove removes the members before the ones they depend on
+func (g *Group) Remove() error {
+	return g.RemoveWith(RemoveOptions{})
+}
+
+// RemoveWith removes the members with the options in the same order as Remove
+func (g *Group) RemoveWith(opts RemoveOptions) error {
+	if err := g.run(true, func(d Daemon) error { return removeWith(d, opts) }); err != nil {
+		return err
+	}
+	return g.removeGroupSection()
+}
+
+// Status prints the status of each member in the order of the dependencies
+func (g *Group) Status() error {
+	var errs GroupError
+	for _, m := range g.ordered() {
+		fmt.Printf("%s: ", m.name)
+		if err := m.d.Status(); err != nil {
+			fmt.Println(err)
+			errs = append(errs, &MemberError{Name: m.name, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ignoreErr treats target as success like Main does, starting a running service or stopping a stopped one
+// is successful by LSB
+func ignoreErr(err, target error) error {
+	if errors.Is(err, target) {
+		return nil
+	}
+	return err
+}
+
+// ordered returns the members sorted by their depth, so each one follows its dependencies
+func (g *Group) ordered() []*groupMember {
+	ordered := make([]*groupMember, 0, len(g.members))
+	for depth := 0; len(ordered) < len(g.members); depth++ {
+		for _, m := range g.members {
+			if m.depth == depth {
+				ordered = append(ordered, m)
+			}
+		}
+	}
+	return ordered
+}
+
+// run runs op on each member once the members it depends on are done, or in reverse once the members
+// which depend on it are done. The members whose dependencies failed are skipped.
+func (g *Group) run(reverse bool, op func(d Daemon) error) error {
+	// the privileges are checked before any member changes, so the group is not left half done
+	for _, m := range g.members {
+		if daemonConfig(m.d) != nil {
+			if err := checkPrivileges(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	// waitFor are the members which must be done first
+	waitFor := make(map[*groupMember][]*groupMember, len(g.members))
+	for _, m := range g.members {
+		if !reverse {
+			waitFor[m] = m.dependsOn
+			continue
+		}
+		for _, dep := range m.dependsOn {
+			waitFor[dep] = append(waitFor[dep], m)
+		}
+	}
+
+	done := make(map[*groupMember]chan struct{}, len(g.members))
+	for _, m := range g.members {
+		done[m] = make(chan struct{})
+	}
+	var mu sync.Mutex
+	failed := make(map[*groupMember]error)
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *groupMember) {
+			defer wg.Done()
+			defer close(done[m])
+			var err error
+			for _, w := range waitFor[m] {
+				<-done[w]
+				mu.Lock()
+				if failed[w] != nil {
+					err = errDependencyFailed
+				}
+				mu.Unlock()
+			}
+			if err == nil {
+				err = op(m.d)
+			}
+			if err != nil {
+				mu.Lock()
+				failed[m] = err
+				mu.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	var errs GroupError
+	for _, m := range g.members {
+		if err := failed[m]; err != nil {
+			errs = append(errs, &MemberError{Name: m.name, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// supervisordMembers returns the program names of the members managed by supervisord
+func (g *Group) supervisordMembers() []string {
+	var programs []string
+	for _, m := range g.members {
+		if s, ok := m.d.(*supervisord); ok {
+			programs = append(programs, s.c.Name)
+		}
+	}
+	return programs
+}
+
+// supervisorServer is the server of supervisord set for the members
+func (g *Group) supervisorServer() string {
+	for _, m := range g.members {
+		if s, ok := m.d.(*supervisord); ok {
+			return s.c.SupervisorServer
+		}
+	}
+	return ""
+}
+
+func (g *Group) groupSectionPath() string {
+	return supervisordGroupPath(g.name)
+}
+
+func supervisordGroupPath(name string) string {
+	return "/etc/supervisor/conf.d/" + name + ".group.ini"
+}
+
+// installGroupSection adds the supervisord members into a group, so they can be managed together by supervisorctl
+func (g *Group) installGroupSection() error {
+	programs := g.supervisordMembers()
+	if len(programs) == 0 {
+		return nil
+	}
+	content, err := renderTemplate("supervisordGroup", supervisordGroup, struct {
+		Name     string
+		Programs []string
+	}{g.name, programs})
+	if err != nil {
+		return err
+	}
+	if err = writeFiles([]Artifact{{Path: g.groupSectionPath(), Mode: 0644, Content: content}}); err != nil {
+		return err
+	}
+	return supervisordUpdate(g.supervisorServer())
+}
+
+func (g *Group) removeGroupSection() error {
+	if len(g.supervisordMembers()) == 0 {
+		return nil
+	}
+	if err := os.Remove(g.groupSectionPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return supervisordUpdate(g.supervisorServer())
+}
+
+// daemonConfig returns the config of the built-in backends, nil for the other implementations of Daemon
+func daemonConfig(d Daemon) *config {
+	switch d := d.(type) {
+	case *systemd:
+		return d.c
+	case *systemv:
+		return d.c
+	case *supervisord:
+		return d.c
+	case *instanceTemplate:
+		return d.c
+	case *cronJob:
+		return d.c
+	}
+	return nil
+}
+
+// withConfig returns a daemon of the same backend as d which uses c, the daemons not created by New are returned as they are
+func withConfig(d Daemon, c *config) Daemon {
+	switch d := d.(type) {
+	case *systemd:
+		return &systemd{c}
+	case *systemv:
+		return &systemv{c}
+	case *supervisord:
+		return &supervisord{c}
+	case *instanceTemplate:
+		return &instanceTemplate{c: c, newInstance: d.newInstance}
+	case *cronJob:
+		return &cronJob{c}
+	}
+	return d
+}
+
+var supervisordGroup = `[group:{{safeName .Name}}]
+programs={{range $i, $p := .Programs}}{{if $i}},{{end}}{{safeName $p}}{{end}}
+`
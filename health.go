@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+var (
+	// errNoHealthCheck appears if the health is checked without WithHealthCheck
+	errNoHealthCheck = errors.New("no health check has been configured")
+
+	// errUnhealthy appears if the health check of the service fails
+	errUnhealthy = errors.New("the health check failed")
+
+	// errInvalidProbe appears if a probe has no target
+	errInvalidProbe = errors.New("the probe needs an url, an address or a command")
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultHealthFailures = 3
+)
+
+type probeKind int
+
+const (
+	httpProbe probeKind = iota + 1
+	tcpProbe
+	execProbe
+)
+
+// Probe is how the health of the service is checked, created by HTTP, TCP or Exec
+type Probe struct {
+	kind   probeKind
+	target string
+	args   []string
+}
+
+// HTTP checks that a GET of the url responds with a 2xx or 3xx status
+func HTTP(url string) Probe {
+	return Probe{kind: httpProbe, target: url}
+}
+
+// TCP checks that the address, e.g. "127.0.0.1:8080", accepts connections
+func TCP(addr string) Probe {
+	return Probe{kind: tcpProbe, target: addr}
+}
+
+// Exec checks that the command exits with 0
+func Exec(cmd string, args ...string) Probe {
+	return Probe{kind: execProbe, target: cmd, args: args}
+}
+
+func (p Probe) String() string {
+	switch p.kind {
+	case httpProbe:
+		return "http " + p.target
+	case tcpProbe:
+		return "tcp " + p.target
+	case execProbe:
+		return "exec " + p.target
+	}
+	return ""
+}
+
+// check runs the probe once, ctx limits how long it may take
+func (p Probe) check(ctx context.Context) error {
+	switch p.kind {
+	case httpProbe:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("%s responded %s", p.target, resp.Status)
+		}
+		return nil
+	case tcpProbe:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", p.target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case execProbe:
+		if out, err := exec.CommandContext(ctx, p.target, p.args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return nil
+	}
+	return errInvalidProbe
+}
+
+// HealthChecker is implemented by the daemons which can check the health of the running service,
+// all the built-in backends do
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+// HealthCheck is the health check set by WithHealthCheck
+type HealthCheck struct {
+	Probe    Probe
+	Interval time.Duration // between the checks of Monitor
+	Timeout  time.Duration // of a single check
+	Failures int           // the consecutive failures which make Monitor restart the service
+}
+
+// WithHealthCheck checks the health of the running service by the probe, e.g. HTTP("http://127.0.0.1:8080/healthz").
+// Health runs a single check and Status prints its result, Monitor runs it every interval and restarts
+// the service after the consecutive failures. The zero values are 30s, 5s and 3 failures.
+func WithHealthCheck(probe Probe, interval, timeout time.Duration, failures int) Configurator {
+	return Option(func(c *config) {
+		if interval <= 0 {
+			interval = defaultHealthInterval
+		}
+		if timeout <= 0 {
+			timeout = defaultHealthTimeout
+		}
+		if failures <= 0 {
+			failures = defaultHealthFailures
+		}
+		c.HealthCheck = &HealthCheck{Probe: probe, Interval: interval, Timeout: timeout, Failures: failures}
+	})
+}
+
+func validateProbe(p Probe) error {
+	if p.kind == 0 || p.target == "" {
+		return errInvalidProbe
+	}
+	return nil
+}
+
+// checkHealth runs the health check of the config once
+func checkHealth(ctx context.Context, c *config) error {
+	if c.HealthCheck == nil {
+		return errNoHealthCheck
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.HealthCheck.Timeout)
+	defer cancel()
+	if err := c.HealthCheck.Probe.check(ctx); err != nil {
+		return fmt.Errorf("%w: %s: %v", errUnhealthy, c.HealthCheck.Probe, err)
+	}
+	return nil
+}
+
+// waitHealthCheck retries the health check until it passes or fails as many times as allowed
+func waitHealthCheck(ctx context.Context, c *config) error {
+	var err error
+	for i := 0; i < c.HealthCheck.Failures; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.HealthCheck.Interval):
+			}
+		}
+		if err = checkHealth(ctx, c); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// printHealth prints the result of the health check in the status of a running service
+func printHealth(c *config) {
+	if c.HealthCheck == nil {
+		return
+	}
+	if err := checkHealth(context.Background(), c); err != nil {
+		fmt.Println("Health check failed: " + err.Error())
+		return
+	}
+	fmt.Println("Health check passed")
+}
+
+// Monitor checks the health of d every interval until ctx is done and restarts it after
+// the consecutive failures set by WithHealthCheck. The checks are skipped while the service is stopped.
+// It's meant to run in a long-running process such as the "monitor" command of Main.
+func Monitor(ctx context.Context, d Daemon) error {
+	c := daemonConfig(d)
+	if c == nil || c.HealthCheck == nil {
+		return errNoHealthCheck
+	}
+	hc, ok := d.(HealthChecker)
+	if !ok {
+		return errUnsupportedOperation
+	}
+	sr, _ := d.(stateReporter)
+	failures := 0
+	ticker := time.NewTicker(c.HealthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if sr != nil && !sr.isRunning() {
+			failures = 0
+			continue
+		}
+		err := hc.Health(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		fmt.Printf("%s: %v (%d/%d)\n", c.serviceName(), err, failures, c.HealthCheck.Failures)
+		if failures >= c.HealthCheck.Failures {
+			failures = 0
+			if err := restart(d); err != nil {
+				fmt.Printf("%s: failed to restart: %v\n", c.serviceName(), err)
+			}
+		}
+	}
+}
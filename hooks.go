@@ -0,0 +1,105 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Hooks are the command lines run around the start and the stop of the service as its user,
+// each one is split into words like the arguments and must start with an absolute path.
+// Systemd runs them as ExecStartPre=, ExecStartPost=, ExecStop= and ExecStopPost=, the init script of systemv
+// runs them around starting and stopping the service, and supervisord runs PreStart in the command of the program
+// before the service and the other ones from an event listener, which can't delay the start or the stop.
+// A failing PreStart stops the service from starting.
+type Hooks struct {
+	PreStart  string `json:"pre_start" yaml:"pre_start" toml:"pre_start"`
+	PostStart string `json:"post_start" yaml:"post_start" toml:"post_start"`
+	PreStop   string `json:"pre_stop" yaml:"pre_stop" toml:"pre_stop"`
+	PostStop  string `json:"post_stop" yaml:"post_stop" toml:"post_stop"`
+}
+
+// WithHooks runs the commands around the start and the stop of the service
+func WithHooks(hooks Hooks) Configurator {
+	return Option(func(c *config) {
+		c.Hooks = hooks
+	})
+}
+
+// OnInstall calls fn at the end of a successful Install, the error of fn fails Install
+func OnInstall(fn func() error) Configurator {
+	return Option(func(c *config) {
+		c.OnInstall = fn
+	})
+}
+
+// OnRemove calls fn at the end of a successful Remove, the error of fn fails Remove
+func OnRemove(fn func() error) Configurator {
+	return Option(func(c *config) {
+		c.OnRemove = fn
+	})
+}
+
+func (c *config) runOnInstall() error {
+	if c.OnInstall == nil {
+		return nil
+	}
+	if err := c.OnInstall(); err != nil {
+		return fmt.Errorf("install hook: %w", err)
+	}
+	return nil
+}
+
+func (c *config) runOnRemove() error {
+	if c.OnRemove == nil {
+		return nil
+	}
+	if err := c.OnRemove(); err != nil {
+		return fmt.Errorf("remove hook: %w", err)
+	}
+	return nil
+}
+
+func validateHook(line string) error {
+	words, err := hookWords(line)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 || !filepath.IsAbs(words[0]) {
+		return errRelativePath
+	}
+	return nil
+}
+
+// hookWords splits the command line of a hook into words
+func hookWords(line string) ([]string, error) {
+	if err := checkControl(line); err != nil {
+		return nil, fmt.Errorf("%q: %w", line, err)
+	}
+	words, err := splitArgs(line)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", line, err)
+	}
+	return words, nil
+}
+
+// systemdHook renders a hook as the command line of an Exec setting
+func systemdHook(line string) (string, error) {
+	words, err := hookWords(line)
+	if err != nil {
+		return "", err
+	}
+	return systemdWords(words), nil
+}
+
+// shellHook renders a hook as the quoted command run by sh -c in the working directory of the service
+func shellHook(c *config, line string) (string, error) {
+	words, err := hookWords(line)
+	if err != nil {
+		return "", err
+	}
+	cmd, err := shellWords(c, words)
+	if err != nil {
+		return "", err
+	}
+	return shellValue(cmd)
+}
@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// errNoInstances appears if Instance is called on a daemon which hasn't been created with WithInstances
+	errNoInstances = errors.New("the daemon has not been created with WithInstances")
+
+	// errInstanceRequired appears if an operation of a single instance is called on the daemon created with WithInstances
+	errInstanceRequired = errors.New("choose an instance with Instance first")
+)
+
+// instanceSpecifier is replaced with the instance name, the same as systemd does in template units
+const instanceSpecifier = "%i"
+
+// WithInstances makes the daemon a template of several instances which run the same executable,
+// each one is managed by the daemon returned by Instance. "%i" in the description, arguments and
+// the log, pid and lock files is replaced with the instance name.
+// Systemd installs a name@.service template unit, the other backends install a service named
+// name@instance for each instance.
+func WithInstances() Configurator {
+	return Option(func(c *config) {
+		c.Instances = true
+	})
+}
+
+// instancer is implemented by all the built-in backends
+type instancer interface {
+	instance(name string) (Daemon, error)
+}
+
+// Instance returns the daemon which manages the instance of d, d must have been created with WithInstances
+func Instance(d Daemon, name string) (Daemon, error) {
+	in, ok := d.(instancer)
+	if !ok {
+		return nil, errNoInstances
+	}
+	return in.instance(name)
+}
+
+// isTemplate reports whether the config is the template of the instances, which can't be started
+func (c *config) isTemplate() bool {
+	return c.Instances && c.Instance == ""
+}
+
+// serviceName is the name of the service managed by the process manager
+func (c *config) serviceName() string {
+	if c.Instance == "" {
+		return c.Name
+	}
+	return c.Name + "@" + c.Instance
+}
+
+// templateConfig is the config which the shared service files are rendered from
+func (c *config) templateConfig() *config {
+	if c.template != nil {
+		return c.template
+	}
+	return c
+}
+
+// forInstance returns a copy of the template config for the instance with the specifier replaced
+func (c *config) forInstance(name string) (*config, error) {
+	if !c.Instances {
+		return nil, errNoInstances
+	}
+	if !validName.MatchString(name) || strings.Contains(name, "@") {
+		return nil, &FieldError{Field: "Instance", Value: name, Err: errInvalidName}
+	}
+	ic := *c
+	ic.Instance = name
+	ic.template = c
+	for _, value := range []*string{&ic.Description, &ic.Args, &ic.LogFile, &ic.StderrLogFile, &ic.PidFile, &ic.LockFile,
+		&ic.Hooks.PreStart, &ic.Hooks.PostStart, &ic.Hooks.PreStop, &ic.Hooks.PostStop} {
+		*value = strings.Replace(*value, instanceSpecifier, name, -1)
+	}
+	if ic.LogOutput.kind == fileOutput {
+		ic.LogOutput = File(ic.LogFile)
+	}
+	return &ic, nil
+}
+
+// standalone turns the instance config into the config of a separate service,
+// for the backends which have no template units
+func (c *config) standalone() *config {
+	c.Name = c.serviceName()
+	c.Instances = false
+	c.Instance = ""
+	c.template = nil
+	return c
+}
+
+// keepInstance restores the specifier escaped by the systemd escaping in a template unit
+func keepInstance(instances bool, value string) string {
+	if !instances {
+		return value
+	}
+	return strings.Replace(value, "%"+instanceSpecifier, instanceSpecifier, -1)
+}
+
+// instanceTemplate is the daemon created with WithInstances for the backends without template units,
+// there is nothing to install until an instance is chosen
+type instanceTemplate struct {
+	c           *config
+	newInstance func(c *config) Daemon
+}
+
+func (t *instanceTemplate) instance(name string) (Daemon, error) {
+	ic, err := t.c.forInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.newInstance(ic.standalone()), nil
+}
+
+func (t *instanceTemplate) Install() error              { return errInstanceRequired }
+func (t *instanceTemplate) Enable() error               { return errInstanceRequired }
+func (t *instanceTemplate) Disable() error              { return errInstanceRequired }
+func (t *instanceTemplate) Remove() error               { return errInstanceRequired }
+func (t *instanceTemplate) Start() error                { return errInstanceRequired }
+func (t *instanceTemplate) Stop() error                 { return errInstanceRequired }
+func (t *instanceTemplate) Restart() error              { return errInstanceRequired }
+func (t *instanceTemplate) Status() error               { return errInstanceRequired }
+func (t *instanceTemplate) Log() error                  { return errInstanceRequired }
+func (t *instanceTemplate) Render() ([]Artifact, error) { return nil, errInstanceRequired }
+
+func (t *instanceTemplate) RemoveWith(opts RemoveOptions) error {
+	return errInstanceRequired
+}
+
+func (t *instanceTemplate) Logs(ctx context.Context, opts LogOptions) error {
+	return errInstanceRequired
+}
+
+func (t *instanceTemplate) LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error) {
+	return nil, errInstanceRequired
+}
+
+func (t *instanceTemplate) Upgrade(newExec string, opts ...UpgradeOptions) error {
+	return errInstanceRequired
+}
+
+func (t *instanceTemplate) Health(ctx context.Context) error {
+	return errInstanceRequired
+}
+
+func (t *instanceTemplate) Watch(ctx context.Context) (<-chan StateEvent, error) {
+	return nil, errInstanceRequired
+}
+
+// withInstances wraps the daemon of a backend without template units if the config is a template
+func withInstances(c *config, newInstance func(c *config) Daemon) Daemon {
+	if c.isTemplate() {
+		return &instanceTemplate{c: c, newInstance: newInstance}
+	}
+	return newInstance(c)
+}
@@ -0,0 +1,266 @@
+package daemon
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultEnvPrefix is used by FromEnv when the prefix is empty
+const defaultEnvPrefix = "DAEMON"
+
+// fileConfig is the representation of config in files and environment variables,
+// the keys are the snake case field names, e.g. work_dir in a file and DAEMON_WORK_DIR in the environment
+type fileConfig struct {
+	Description  string `json:"description" yaml:"description" toml:"description"`
+	Name         string `json:"name" yaml:"name" toml:"name"`
+	Exec         string `json:"exec" yaml:"exec" toml:"exec"`
+	Args         string `json:"args" yaml:"args" toml:"args"`
+	WorkDir      string `json:"work_dir" yaml:"work_dir" toml:"work_dir"`
+	Dependencies string `json:"dependencies" yaml:"dependencies" toml:"dependencies"`
+	User         string `json:"user" yaml:"user" toml:"user"`
+	Group        string `json:"group" yaml:"group" toml:"group"`
+	LogFile      string `json:"log_file" yaml:"log_file" toml:"log_file"`
+	PidFile      string `json:"pid_file" yaml:"pid_file" toml:"pid_file"`
+	LockFile     string `json:"lock_file" yaml:"lock_file" toml:"lock_file"`
+	// StderrLogFile is set by WithStderrLogFile
+	StderrLogFile string `json:"stderr_log_file" yaml:"stderr_log_file" toml:"stderr_log_file"`
+	// SupervisorServer is set by WithSupervisorServer
+	SupervisorServer string `json:"supervisor_server" yaml:"supervisor_server" toml:"supervisor_server"`
+
+	// the structured fields are loaded from the environment as JSON, e.g. DAEMON_LOG_ROTATION='{"keep": 5}'
+	Rotation    *Rotation `json:"log_rotation" yaml:"log_rotation" toml:"log_rotation"`
+	CreateUser  *UserSpec `json:"create_user" yaml:"create_user" toml:"create_user"`
+	Directories *Dirs     `json:"directories" yaml:"directories" toml:"directories"`
+	Deps        *[]Dep    `json:"depends" yaml:"depends" toml:"depends"`
+	Schedule    *Schedule `json:"schedule" yaml:"schedule" toml:"schedule"`
+	Sockets     *[]Listen `json:"sockets" yaml:"sockets" toml:"sockets"`
+	Hooks       *Hooks    `json:"hooks" yaml:"hooks" toml:"hooks"`
+	// HealthCheck replaces the health check set by WithHealthCheck as a whole
+	HealthCheck *healthCheckSpec `json:"health_check" yaml:"health_check" toml:"health_check"`
+
+	// the fields which implement encoding.TextUnmarshaler and the booleans are loaded from the environment as well
+	LogOutput                *LogOutput  `json:"log_output" yaml:"log_output" toml:"log_output"`
+	Escalation               *Escalation `json:"escalation" yaml:"escalation" toml:"escalation"`
+	NonInteractiveEscalation *bool       `json:"non_interactive_escalation" yaml:"non_interactive_escalation" toml:"non_interactive_escalation"`
+	Instances                *bool       `json:"instances" yaml:"instances" toml:"instances"`
+}
+
+// fileOption is a field of fileConfig which converts itself into the config,
+// because it's written differently in a file than the config field of the same name
+type fileOption interface {
+	applyTo(c *config) error
+}
+
+// healthCheckSpec is the health check in a file, one of HTTP, TCP and Exec is the probe,
+// Exec is a command line split like WithArgs. The durations are written like "30s", the zero values
+// are the defaults of WithHealthCheck.
+type healthCheckSpec struct {
+	HTTP     string `json:"http" yaml:"http" toml:"http"`
+	TCP      string `json:"tcp" yaml:"tcp" toml:"tcp"`
+	Exec     string `json:"exec" yaml:"exec" toml:"exec"`
+	Interval string `json:"interval" yaml:"interval" toml:"interval"`
+	Timeout  string `json:"timeout" yaml:"timeout" toml:"timeout"`
+	Failures int    `json:"failures" yaml:"failures" toml:"failures"`
+}
+
+func (s *healthCheckSpec) applyTo(c *config) error {
+	var probe Probe
+	switch {
+	case s.HTTP != "":
+		probe = HTTP(s.HTTP)
+	case s.TCP != "":
+		probe = TCP(s.TCP)
+	case s.Exec != "":
+		words, err := splitArgs(s.Exec)
+		if err != nil {
+			return &FieldError{Field: "HealthCheck", Value: s.Exec, Err: err}
+		}
+		if len(words) > 0 {
+			probe = Exec(words[0], words[1:]...)
+		}
+	}
+	var durations [2]time.Duration
+	for i, value := range []string{s.Interval, s.Timeout} {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return &FieldError{Field: "HealthCheck", Value: value, Err: err}
+		}
+		durations[i] = d
+	}
+	return WithHealthCheck(probe, durations[0], durations[1], s.Failures).apply(c)
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	fileOptionType      = reflect.TypeOf((*fileOption)(nil)).Elem()
+)
+
+type loader func(c *config) error
+
+func (f loader) apply(c *config) error {
+	return f(c)
+}
+
+// FromFile loads the config from a JSON, YAML or TOML file, the format is chosen by the file extension.
+// Only the fields present in the file override the current values.
+func FromFile(path string) Configurator {
+	return loader(func(c *config) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		fc := newFileConfig(c)
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			err = json.Unmarshal(data, fc)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, fc)
+		case ".toml":
+			err = toml.Unmarshal(data, fc)
+		default:
+			return fmt.Errorf("failed to load config from %s: %w", path, errUnknownConfigFormat)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load config from %s: %w", path, err)
+		}
+		if err = fc.applyTo(c); err != nil {
+			return fmt.Errorf("failed to load config from %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// FromEnv loads the config from environment variables named by the prefix and the upper snake case field name,
+// e.g. DAEMON_EXEC and DAEMON_LOG_FILE for prefix "DAEMON", which is also used if the prefix is empty.
+// The structured fields such as DAEMON_LOG_ROTATION and DAEMON_DEPENDS are JSON written like in a JSON file.
+// Only the variables which are set override the current values.
+func FromEnv(prefix string) Configurator {
+	return loader(func(c *config) error {
+		if prefix == "" {
+			prefix = defaultEnvPrefix
+		}
+		fc := newFileConfig(c)
+		v := reflect.ValueOf(fc).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			key := prefix + "_" + strings.ToUpper(v.Type().Field(i).Tag.Get("json"))
+			value, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			field := v.Field(i)
+			if field.Kind() == reflect.String {
+				field.SetString(value)
+				continue
+			}
+			if field.Kind() != reflect.Ptr {
+				continue
+			}
+			ptr := reflect.New(field.Type().Elem())
+			if ptr.Elem().Kind() == reflect.Bool {
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("failed to load config from %s: %w", key, err)
+				}
+				ptr.Elem().SetBool(b)
+				field.Set(ptr)
+				continue
+			}
+			if unmarshaler, ok := ptr.Interface().(encoding.TextUnmarshaler); ok {
+				if err := unmarshaler.UnmarshalText([]byte(value)); err != nil {
+					return fmt.Errorf("failed to load config from %s: %w", key, err)
+				}
+				field.Set(ptr)
+				continue
+			}
+			// like in a file, the keys missing from the JSON keep the current values
+			if !field.IsNil() {
+				ptr = field
+			}
+			if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+				return fmt.Errorf("failed to load config from %s: %w", key, err)
+			}
+			field.Set(ptr)
+		}
+		if err := fc.applyTo(c); err != nil {
+			return fmt.Errorf("failed to load config from %s: %w", prefix, err)
+		}
+		return nil
+	})
+}
+
+// newFileConfig points the structured fields to copies of the current values,
+// so the keys missing from a file keep their values instead of being zeroed,
+// the fields which are parsed from text or converted by themselves as a whole are left nil
+func newFileConfig(c *config) *fileConfig {
+	fc := &fileConfig{}
+	v := reflect.ValueOf(fc).Elem()
+	current := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.Ptr || field.Type().Implements(textUnmarshalerType) || field.Type().Implements(fileOptionType) {
+			continue
+		}
+		value := current.FieldByName(v.Type().Field(i).Name)
+		if value.Kind() == reflect.Ptr {
+			// optional settings stay nil until the file sets them
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		field.Set(reflect.New(field.Type().Elem()))
+		field.Elem().Set(value)
+	}
+	return fc
+}
+
+// applyTo copies the non-empty strings and the non-nil structured fields to the config,
+// the fields of both structs share the same names
+func (fc *fileConfig) applyTo(c *config) error {
+	src := reflect.ValueOf(fc).Elem()
+	dst := reflect.ValueOf(c).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if opt, ok := src.Field(i).Interface().(fileOption); ok {
+			if !src.Field(i).IsNil() {
+				if err := opt.applyTo(c); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		field := dst.FieldByName(src.Type().Field(i).Name)
+		switch value := src.Field(i); value.Kind() {
+		case reflect.String:
+			if value.String() != "" {
+				field.SetString(value.String())
+			}
+		case reflect.Ptr:
+			if value.IsNil() {
+				continue
+			}
+			if field.Kind() == reflect.Ptr {
+				field.Set(value)
+			} else {
+				field.Set(value.Elem())
+			}
+			// the log file is part of the file output
+			if output, ok := value.Interface().(*LogOutput); ok && output != nil && output.kind == fileOutput {
+				c.LogFile = output.path
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultSyslogFacility = "daemon"
+
+var (
+	// errUnknownLogOutput appears if a log output can't be parsed
+	errUnknownLogOutput = errors.New("unknown log output, expect journal, file:<path>, syslog[:<facility>] or null")
+
+	// errNoStderrLog appears if the stderr log is requested but stderr isn't separated by WithStderrLogFile
+	errNoStderrLog = errors.New("stderr is logged together with stdout, use WithStderrLogFile to separate it")
+
+	// errLogNotReadable appears if the log output of the service can't be read back by the library
+	errLogNotReadable = errors.New("the log output can't be read")
+)
+
+type logOutputKind int
+
+const (
+	// autoOutput lets the backend choose, the journal on systemd and the log file on the others
+	autoOutput logOutputKind = iota
+	journalOutput
+	fileOutput
+	syslogOutput
+	nullOutput
+)
+
+// LogOutput is where the stdout and stderr of the service go, one of Journal, File, Syslog and Null.
+// It applies to stderr as well unless WithStderrLogFile is used.
+// Supervisord has no journal support and sends both Journal and Syslog to syslog with its own facility.
+type LogOutput struct {
+	kind     logOutputKind
+	path     string
+	facility string
+}
+
+var (
+	// Journal sends the output to the systemd journal, hosts without systemd use syslog instead
+	Journal = LogOutput{kind: journalOutput}
+
+	// Null discards the output
+	Null = LogOutput{kind: nullOutput}
+)
+
+// File appends the output to the file at path, it's the same as WithLogFile(path)
+func File(path string) LogOutput {
+	return LogOutput{kind: fileOutput, path: path}
+}
+
+// Syslog sends the output to syslog with the facility, e.g. "daemon" or "local0"
+func Syslog(facility string) LogOutput {
+	if facility == "" {
+		facility = defaultSyslogFacility
+	}
+	return LogOutput{kind: syslogOutput, facility: facility}
+}
+
+// logFacility returns the syslog facility of the output, the default one if it's not set
+func logFacility(o LogOutput) (string, error) {
+	if o.facility == "" {
+		return defaultSyslogFacility, nil
+	}
+	return safeName(o.facility)
+}
+
+func (o LogOutput) String() string {
+	switch o.kind {
+	case journalOutput:
+		return "journal"
+	case fileOutput:
+		return "file:" + o.path
+	case syslogOutput:
+		return "syslog:" + o.facility
+	case nullOutput:
+		return "null"
+	}
+	return ""
+}
+
+// UnmarshalText parses the format returned by String, so the output can be loaded by FromFile and FromEnv
+func (o *LogOutput) UnmarshalText(text []byte) error {
+	kind, arg := string(text), ""
+	if i := strings.IndexByte(kind, ':'); i >= 0 {
+		kind, arg = kind[:i], kind[i+1:]
+	}
+	switch {
+	case kind == "journal" && arg == "":
+		*o = Journal
+	case kind == "file" && arg != "":
+		*o = File(arg)
+	case kind == "syslog":
+		*o = Syslog(arg)
+	case kind == "null" && arg == "":
+		*o = Null
+	default:
+		return fmt.Errorf("%q: %w", text, errUnknownLogOutput)
+	}
+	return nil
+}
+
+func WithLogOutput(output LogOutput) Configurator {
+	return Option(func(c *config) {
+		c.LogOutput = output
+		if output.kind == fileOutput {
+			c.LogFile = output.path
+		}
+	})
+}
+
+// WithStderrLogFile appends the stderr of the service to its own file instead of the log output
+func WithStderrLogFile(path string) Configurator {
+	return Option(func(c *config) {
+		c.StderrLogFile = path
+	})
+}
+
+// logKind is used by the templates to tell the outputs apart
+func logKind(o LogOutput) string {
+	return strings.SplitN(o.String(), ":", 2)[0]
+}
+
+// logFiles returns the files written with the service's output
+func (c *config) logFiles() []string {
+	var files []string
+	if c.LogOutput.kind == fileOutput {
+		files = append(files, c.LogFile)
+	}
+	if c.StderrLogFile != "" {
+		files = append(files, c.StderrLogFile)
+	}
+	return files
+}
+
+// prepareLogFile creates the log files and their missing directories owned by the service's user and group,
+// the existing directories are left untouched
+func prepareLogFile(c *config) error {
+	if c.dynamicUser() {
+		// systemd opens the log files as root and the user only exists while the service runs
+		return nil
+	}
+	for _, logFile := range c.logFiles() {
+		// the log files are opened by root for appending, a link planted in a directory owned
+		// by the service's user would let it append to any file
+		if err := checkSymlinks(logFile); err != nil {
+			return err
+		}
+		if pathOrFileIsExist(logFile) {
+			continue
+		}
+		if err := createLogFile(logFile, c.User, c.Group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createLogFile(logFile, userName, groupName string) error {
+	uid, gid, err := lookupOwner(userName, groupName)
+	if err != nil {
+		return err
+	}
+
+	if _, err = mkdirOwned(filepath.Dir(logFile), 0755, uid, gid); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL|openNoFollow, 0640)
+	if err != nil {
+		return err
+	}
+	if err = file.Chown(uid, gid); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// renderLogRotateFor renders the logrotate config of the files written by the service if there are any
+func renderLogRotateFor(c *config, files []Artifact, sizeRotation bool) ([]Artifact, error) {
+	logFiles := c.logFiles()
+	if len(logFiles) == 0 {
+		return files, nil
+	}
+	// a template's config rotates the log files of all the instances
+	if c.isTemplate() {
+		for i, f := range logFiles {
+			logFiles[i] = strings.Replace(f, instanceSpecifier, "*", -1)
+		}
+	}
+	logRotate, err := renderLogRotate(c, sizeRotation, logFiles...)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, logRotate), nil
+}
+
+// logFilePath returns the log file of the chosen stream
+func logFilePath(c *config, opts LogOptions) (string, error) {
+	if opts.Stream != Stderr {
+		return c.LogFile, nil
+	}
+	if c.StderrLogFile == "" {
+		return "", errNoStderrLog
+	}
+	return c.StderrLogFile, nil
+}
+
+// fileLogs writes the log file of the chosen stream
+func fileLogs(ctx context.Context, c *config, opts LogOptions) error {
+	if opts.hasTimeFilter() {
+		return errLogFilterUnsupported
+	}
+	logFile, err := logFilePath(c, opts)
+	if err != nil {
+		return err
+	}
+	lines := opts.Lines
+	if lines < 0 {
+		// a negative number would skip the existing lines
+		lines = 0
+	}
+	return tailFile(ctx, logFile, lines, opts.Follow, opts.writer())
+}
+
+// fileEntries is the LogEntries counterpart of fileLogs, the log file is opened first,
+// so a missing or unreadable file is reported instead of an empty channel
+func fileEntries(ctx context.Context, c *config, opts LogOptions, logs func(ctx context.Context, opts LogOptions) error) (<-chan LogEntry, error) {
+	logFile, err := logFilePath(c, opts)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(logFile)
+	if err != nil {
+		return nil, err
+	}
+	_ = file.Close()
+	return lineEntries(ctx, c.serviceName(), opts, logs)
+}
+
+// syslogLogs writes the syslog messages of the service found in the journal, hosts without journald can't read them
+func syslogLogs(ctx context.Context, c *config, opts LogOptions) error {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		return errLogNotReadable
+	}
+	args := append([]string{"-t", c.Name}, opts.journalArgs()...)
+	return runLogCommand(ctx, opts.writer(), "journalctl", args...)
+}
+
+// syslogEntries is the LogEntries counterpart of syslogLogs
+func syslogEntries(ctx context.Context, c *config, opts LogOptions) (<-chan LogEntry, error) {
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		return nil, errLogNotReadable
+	}
+	return journalEntries(ctx, c.Name, opts, "-t", c.Name)
+}
+
+// lookupOwner returns the numeric ids of the user and group
+func lookupOwner(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	g, err := user.LookupGroup(groupName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
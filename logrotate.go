@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+var (
+	// errUnknownRotationPeriod appears if the rotation period is not one of Daily, Weekly and Monthly
+	errUnknownRotationPeriod = errors.New("unknown rotation period, expect daily, weekly, monthly or empty")
+
+	// errNegativeRotation appears if the number of rotated logs or the size limit is negative
+	errNegativeRotation = errors.New("must not be negative")
+)
+
+// RotationPeriod is how often the log is rotated by logrotate
+type RotationPeriod string
+
+const (
+	Daily   RotationPeriod = "daily"
+	Weekly  RotationPeriod = "weekly"
+	Monthly RotationPeriod = "monthly"
+)
+
+const (
+	defaultRotationKeep    = 10
+	defaultRotationMaxSize = 50 << 20
+)
+
+// Rotation configures how the log files written by the service are rotated.
+// Logrotate does the rotation for the systemv backend, supervisord rotates by size itself
+// and leaves the periodic rotation to logrotate.
+type Rotation struct {
+	Period   RotationPeriod `json:"period" yaml:"period" toml:"period"`       // rotate every period, only by size if it's empty
+	Keep     int            `json:"keep" yaml:"keep" toml:"keep"`             // the number of rotated logs to keep, 10 if it's 0
+	MaxSize  int64          `json:"max_size" yaml:"max_size" toml:"max_size"` // rotate once the log is bigger than MaxSize bytes, 0 means no limit
+	Compress bool           `json:"compress" yaml:"compress" toml:"compress"` // gzip the rotated logs
+}
+
+func defaultRotation() Rotation {
+	return Rotation{Period: Daily, Keep: defaultRotationKeep, MaxSize: defaultRotationMaxSize, Compress: true}
+}
+
+// WithLogRotation sets how the log files are rotated, the zero Keep is 10 rotated logs,
+// since keeping none would delete the log on each rotation
+func WithLogRotation(rotation Rotation) Configurator {
+	return Option(func(c *config) {
+		c.Rotation = rotation
+	})
+}
+
+// validateRotation rejects the periods unknown to logrotate, which would be written into the config as directives
+func validateRotation(r Rotation) error {
+	switch r.Period {
+	case "", Daily, Weekly, Monthly:
+	default:
+		return &FieldError{Field: "Rotation.Period", Value: string(r.Period), Err: errUnknownRotationPeriod}
+	}
+	if r.Keep < 0 {
+		return &FieldError{Field: "Rotation.Keep", Value: strconv.Itoa(r.Keep), Err: errNegativeRotation}
+	}
+	if r.MaxSize < 0 {
+		return &FieldError{Field: "Rotation.MaxSize", Value: strconv.FormatInt(r.MaxSize, 10), Err: errNegativeRotation}
+	}
+	return nil
+}
+
+func logRotateConfPath(name string) string {
+	return "/etc/logrotate.d/" + name
+}
+
+// renderLogRotate renders the logrotate config of the log files, sizeRotation is false if
+// the size limit is already enforced by the process manager
+func renderLogRotate(c *config, sizeRotation bool, logFiles ...string) (Artifact, error) {
+	if err := validateRotation(c.Rotation); err != nil {
+		return Artifact{}, err
+	}
+	data := struct {
+		LogFiles []string
+		Period   RotationPeriod
+		Keep     int
+		MaxSize  string
+		Compress bool
+	}{
+		LogFiles: logFiles,
+		Period:   c.Rotation.Period,
+		Keep:     c.Rotation.Keep,
+		Compress: c.Rotation.Compress,
+	}
+	if sizeRotation && c.Rotation.MaxSize > 0 {
+		data.MaxSize = strconv.FormatInt(c.Rotation.MaxSize, 10)
+	}
+	content, err := renderTemplate("logRotateConf", logRotateConf, data)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{Path: logRotateConfPath(c.Name), Mode: 0644, Content: content}, nil
+}
+
+// removeLogRotate removes the logrotate config of the service if it has been installed
+func removeLogRotate(name string) error {
+	if err := os.Remove(logRotateConfPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var logRotateConf = `{{range .LogFiles}}{{logrotatePath .}} {{end}}{
+    copytruncate
+{{- if .Period}}
+    {{.Period}}
+{{- end}}
+{{- if .MaxSize}}
+    {{if .Period}}maxsize{{else}}size{{end}} {{.MaxSize}}
+{{- end}}
+    rotate {{.Keep}}
+    missingok
+    notifempty
+    dateext
+    dateformat -%Y%m%d-%s
+{{- if .Compress}}
+    compress
+    delaycompress
+{{- end}}
+    nomail
+    noolddir
+}
+`
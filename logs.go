@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultLogLines is the number of lines printed by Log before following
+	defaultLogLines = 10
+
+	// journalTimeLayout is the time format accepted by journalctl --since and --until
+	journalTimeLayout = "2006-01-02 15:04:05"
+
+	// supervisorLineBytes is the estimated line length used to convert lines into bytes for supervisorctl tail
+	supervisorLineBytes = 512
+
+	// supervisorTailBytes is the number of bytes read by supervisorctl tail when all lines are requested
+	supervisorTailBytes = 1 << 20
+)
+
+// errLogFilterUnsupported appears if Since or Until is used with a log which has no timestamps to filter by
+var errLogFilterUnsupported = errors.New("filtering by time is not supported by this log")
+
+// LogReader is implemented by the daemons which can write the chosen part of their log,
+// all the built-in backends do. Logs returns once the lines are written, or once ctx is done while following.
+type LogReader interface {
+	Logs(ctx context.Context, opts LogOptions) error
+}
+
+// LogOptions specifies which part of the service's log is written by Logs and where to
+type LogOptions struct {
+	Follow bool      // keep writing new lines until the context is done
+	Lines  int       // the number of last lines to write, all lines if it's zero
+	Since  time.Time // write the lines logged after the time, ignored if zero
+	Until  time.Time // write the lines logged before the time, ignored if zero
+	Writer io.Writer // where to write the log, os.Stdout if nil
+	Stream LogStream // which output of the service to write
+}
+
+// LogStream selects the stdout or the stderr log of the service
+type LogStream int
+
+const (
+	// Stdout is the log of the stdout, which includes stderr as well unless WithStderrLogFile is used
+	Stdout LogStream = iota
+	// Stderr is the log of the stderr, it requires WithStderrLogFile
+	Stderr
+)
+
+func (o LogOptions) writer() io.Writer {
+	if o.Writer == nil {
+		return os.Stdout
+	}
+	return o.Writer
+}
+
+func (o LogOptions) hasTimeFilter() bool {
+	return !o.Since.IsZero() || !o.Until.IsZero()
+}
+
+// journalArgs converts the options into journalctl arguments
+func (o LogOptions) journalArgs() []string {
+	args := []string{"--no-pager"}
+	// journalctl -f shows the last 10 lines without -n
+	if o.Lines > 0 {
+		args = append(args, "-n", strconv.Itoa(o.Lines))
+	} else {
+		args = append(args, "-n", "all")
+	}
+	if !o.Since.IsZero() {
+		args = append(args, "--since", o.Since.Local().Format(journalTimeLayout))
+	}
+	if !o.Until.IsZero() {
+		args = append(args, "--until", o.Until.Local().Format(journalTimeLayout))
+	}
+	if o.Follow {
+		args = append(args, "-f")
+	}
+	return args
+}
+
+// followLog implements Log() on top of Logs, it follows the log until Ctrl-C is pressed
+func followLog(logs func(ctx context.Context, opts LogOptions) error) error {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	return logs(ctx, LogOptions{Follow: true, Lines: defaultLogLines, Writer: os.Stdout})
+}
+
+// interruptContext returns a context which is canceled on SIGINT or SIGTERM
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// runLogCommand runs the command writing its output to w until it exits or the context is done,
+// canceling the context is the normal way to stop following a log so it is not reported as an error
+func runLogCommand(ctx context.Context, w io.Writer, name string, arg ...string) error {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// lastLinesWriter keeps the last n lines written into it
+type lastLinesWriter struct {
+	n     int
+	lines [][]byte
+	part  []byte
+}
+
+func (w *lastLinesWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.part = append(w.part, b)
+		if b == '\n' {
+			w.lines = append(w.lines, w.part)
+			w.part = nil
+			if len(w.lines) > w.n {
+				w.lines = w.lines[1:]
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the kept lines into dst
+func (w *lastLinesWriter) flush(dst io.Writer) error {
+	lines := w.lines
+	if len(w.part) > 0 {
+		lines = append(lines, w.part)
+		if len(lines) > w.n {
+			lines = lines[1:]
+		}
+	}
+	for _, line := range lines {
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
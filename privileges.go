@@ -0,0 +1,195 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the capabilities which allow a non-root process to write the service files and to manage the services,
+// see capabilities(7)
+const (
+	capDacOverride = 1
+	capSysAdmin    = 21
+)
+
+// procStatusPath is where the effective capabilities of the process are read from
+const procStatusPath = "/proc/self/status"
+
+// checkPrivileges returns errRootPrivileges if the process can't manage system services.
+// It's required by the operations which change the system: Install, Enable, Disable, Remove, Start, Stop and Restart,
+// while the read-only ones like Status and Log can be used by any user who can read the service's state and log.
+func checkPrivileges() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if hasCapabilities(capDacOverride, capSysAdmin) {
+		return nil
+	}
+	return errRootPrivileges
+}
+
+// hasCapabilities reports whether all the capabilities are in the effective set of the process
+func hasCapabilities(caps ...uint) bool {
+	effective, ok := effectiveCapabilities()
+	if !ok {
+		return false
+	}
+	for _, c := range caps {
+		if effective&(1<<c) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// effectiveCapabilities parses the CapEff line of /proc/self/status
+func effectiveCapabilities() (uint64, bool) {
+	file, err := os.Open(procStatusPath)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		return caps, true
+	}
+	return 0, false
+}
+
+// escalatedEnv marks the process re-executed by escalation, so it never escalates again
+const escalatedEnv = "DAEMON_ESCALATED"
+
+// Escalation is how an unprivileged process gains the privileges required by an operation
+type Escalation int
+
+const (
+	// None returns errRootPrivileges without trying to escalate
+	None Escalation = iota
+	// Sudo re-executes the process with sudo
+	Sudo
+	// Pkexec re-executes the process with pkexec, which asks for the password through the polkit agent
+	Pkexec
+)
+
+// errUnknownEscalation appears if the escalation loaded from a file is not none, sudo or pkexec
+var errUnknownEscalation = errors.New("unknown escalation, expect none, sudo or pkexec")
+
+var escalationNames = map[Escalation]string{None: "none", Sudo: "sudo", Pkexec: "pkexec"}
+
+func (e Escalation) String() string {
+	return escalationNames[e]
+}
+
+// UnmarshalText parses the escalation written as none, sudo or pkexec
+func (e *Escalation) UnmarshalText(text []byte) error {
+	for escalation, name := range escalationNames {
+		if string(text) == name {
+			*e = escalation
+			return nil
+		}
+	}
+	return fmt.Errorf("%q: %w", text, errUnknownEscalation)
+}
+
+// WithEscalation makes Main re-execute the current binary with the arguments passed to Main under sudo or pkexec
+// when a command which changes the system runs without the required privileges,
+// Main exits with the exit code of the re-executed binary then.
+// The methods of Daemon never escalate, they return errRootPrivileges.
+// Escalation is refused in non-interactive sessions unless WithNonInteractiveEscalation is used as well.
+func WithEscalation(escalation Escalation) Configurator {
+	return Option(func(c *config) {
+		c.Escalation = escalation
+	})
+}
+
+// WithNonInteractiveEscalation allows escalating when stdin is not a terminal,
+// sudo is run with -n in that case so it fails instead of waiting for a password
+func WithNonInteractiveEscalation() Configurator {
+	return Option(func(c *config) {
+		c.NonInteractiveEscalation = true
+	})
+}
+
+// Escalate checks the privileges before an operation which changes the system starts, and re-executes
+// the current binary with args as configured by WithEscalation if they are missing. args are the arguments
+// after the program name which run the same operation again, such as os.Args[1:].
+// escalated reports whether the binary has been re-executed, the caller should exit with code instead
+// of running the operation then. err is errRootPrivileges if the privileges are missing and can't be escalated.
+// The daemons which are not created by New are left to check their own privileges.
+func Escalate(d Daemon, args []string) (code int, escalated bool, err error) {
+	c := daemonConfig(d)
+	if c == nil {
+		return 0, false, nil
+	}
+	if err = checkPrivileges(); err == nil || c.Escalation == None {
+		return 0, false, err
+	}
+	if os.Getenv(escalatedEnv) != "" {
+		// the escalated process is still not privileged, e.g. sudo is limited by a policy
+		return 0, false, err
+	}
+	if code, err = escalate(c, args); err != nil {
+		return 0, false, err
+	}
+	return code, true, nil
+}
+
+// escalate runs the current binary with the arguments under sudo or pkexec and returns its exit code,
+// the error is only returned if the binary can't be run
+func escalate(c *config, arguments []string) (int, error) {
+	interactive := isTerminal(os.Stdin)
+	if !interactive && !c.NonInteractiveEscalation {
+		return 0, errNonInteractiveEscalation
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	// env passes the marker through sudo and pkexec, which both reset the environment
+	args := append([]string{"env", escalatedEnv + "=1", exe}, arguments...)
+	var name string
+	switch c.Escalation {
+	case Sudo:
+		name = "sudo"
+		if !interactive {
+			args = append([]string{"-n"}, args...)
+		}
+	case Pkexec:
+		name = "pkexec"
+	default:
+		return 0, errRootPrivileges
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, fmt.Errorf("failed to escalate with %s: %w", name, err)
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
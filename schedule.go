@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	// errScheduleUnsupported appears if the process manager can't run scheduled jobs or the schedule can't be translated for it
+	errScheduleUnsupported = errors.New("the schedule is not supported by the process manager")
+
+	// errInvalidSchedule appears if neither or both of OnCalendar and Every are set, or Every is shorter than a second
+	errInvalidSchedule = errors.New("set either OnCalendar or an Every of at least a second")
+
+	// errScheduled appears if a scheduled job is started or stopped on a host where cron runs it
+	errScheduled = errors.New("the job is run by cron on schedule and can't be started or stopped")
+)
+
+// Schedule runs the executable as a job on schedule instead of a long-running daemon, set one of the fields
+type Schedule struct {
+	// OnCalendar is a systemd calendar expression, e.g. "daily" or "*-*-* 03:30:00"
+	OnCalendar string `json:"on_calendar" yaml:"on_calendar" toml:"on_calendar"`
+	// Every runs the job repeatedly, the first time once the host has been up for Every
+	Every time.Duration `json:"every" yaml:"every" toml:"every"`
+}
+
+// OnCalendar returns the schedule of a systemd calendar expression
+func OnCalendar(expr string) Schedule {
+	return Schedule{OnCalendar: expr}
+}
+
+// Every returns the schedule which runs the job every d
+func Every(d time.Duration) Schedule {
+	return Schedule{Every: d}
+}
+
+// WithSchedule runs the executable as a job on schedule. Systemd installs a Type=oneshot service and
+// a timer unit, which is what Start and Stop arm and disarm. Systemv hosts get an /etc/cron.d entry instead,
+// which only accepts the schedules cron can express, e.g. "daily", "*-*-* 03:30" or an Every dividing an hour or a day.
+// Supervisord can't run scheduled jobs, so New fails with an unsupported error.
+func WithSchedule(schedule Schedule) Configurator {
+	return Option(func(c *config) {
+		c.Schedule = &schedule
+	})
+}
+
+func validateSchedule(s *Schedule) error {
+	if (s.OnCalendar == "") == (s.Every == 0) || (s.Every != 0 && s.Every < time.Second) {
+		return errInvalidSchedule
+	}
+	return checkControl(s.OnCalendar)
+}
+
+// timerSpan renders the duration as the seconds of a systemd time span
+func timerSpan(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+// cronShortcuts are the systemd calendar shortcuts, e.g. weekly is Monday at midnight
+var cronShortcuts = map[string]string{
+	"minutely": "* * * * *",
+	"hourly":   "0 * * * *",
+	"daily":    "0 0 * * *",
+	"weekly":   "0 0 * * 1",
+	"monthly":  "0 0 1 * *",
+	"yearly":   "0 0 1 1 *",
+	"annually": "0 0 1 1 *",
+}
+
+// dailyCalendar matches a calendar expression run every day at a time, e.g. "*-*-* 03:30:00" or "*:15"
+var dailyCalendar = regexp.MustCompile(`^(?:\*-\*-\* )?(\*|[01]?[0-9]|2[0-3]):([0-5]?[0-9])(?::00)?$`)
+
+// cronSchedule translates the schedule into the time fields of a crontab line
+func cronSchedule(s *Schedule) (string, error) {
+	if s.Every != 0 {
+		if s.Every%time.Minute != 0 {
+			return "", fmt.Errorf("every %s: %w", s.Every, errScheduleUnsupported)
+		}
+		minutes := int(s.Every / time.Minute)
+		switch {
+		case minutes == 1:
+			return "* * * * *", nil
+		case minutes < 60 && 60%minutes == 0:
+			return fmt.Sprintf("*/%d * * * *", minutes), nil
+		case minutes == 60:
+			return "0 * * * *", nil
+		case minutes == 24*60:
+			return "0 0 * * *", nil
+		case minutes%60 == 0 && minutes < 24*60 && 24%(minutes/60) == 0:
+			return fmt.Sprintf("0 */%d * * *", minutes/60), nil
+		}
+		return "", fmt.Errorf("every %s: %w", s.Every, errScheduleUnsupported)
+	}
+	if fields, ok := cronShortcuts[s.OnCalendar]; ok {
+		return fields, nil
+	}
+	if m := dailyCalendar.FindStringSubmatch(s.OnCalendar); m != nil {
+		minute, _ := strconv.Atoi(m[2])
+		hour := m[1]
+		if hour != "*" {
+			h, _ := strconv.Atoi(hour)
+			hour = strconv.Itoa(h)
+		}
+		return fmt.Sprintf("%d %s * * *", minute, hour), nil
+	}
+	return "", fmt.Errorf("%q: %w", s.OnCalendar, errScheduleUnsupported)
+}
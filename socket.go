@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	// errSocketUnsupported appears if socket activation is used with a process manager other than systemd
+	errSocketUnsupported = errors.New("socket activation is only supported by systemd")
+
+	// errInvalidListen appears if a socket has an unknown type or an empty address
+	errInvalidListen = errors.New("expect a stream or datagram socket with an address")
+)
+
+// SocketType is the type of a socket listened by systemd for the service
+type SocketType string
+
+const (
+	Stream   SocketType = "stream"   // a TCP or a unix stream socket, ListenStream=
+	Datagram SocketType = "datagram" // a UDP or a unix datagram socket, ListenDatagram=
+)
+
+// Listen is a socket which systemd listens on and passes to the service,
+// the address is a port such as "8080", an address such as "127.0.0.1:8080" or the path of a unix socket
+type Listen struct {
+	Type    SocketType `json:"type" yaml:"type" toml:"type"`
+	Address string     `json:"address" yaml:"address" toml:"address"`
+}
+
+// WithSocket makes systemd listen on the sockets and start the service on the first connection.
+// Install enables the name.socket unit instead of the service, Restart only restarts the service,
+// so the sockets stay open and no connection is refused. The service gets the sockets by Listeners.
+func WithSocket(listens ...Listen) Configurator {
+	return Option(func(c *config) {
+		c.Sockets = append(c.Sockets, listens...)
+	})
+}
+
+func validateListen(l Listen) error {
+	if (l.Type != Stream && l.Type != Datagram) || strings.TrimSpace(l.Address) == "" {
+		return errInvalidListen
+	}
+	return checkControl(l.Address)
+}
+
+// listenDirective is the setting of the socket unit for the socket type
+func listenDirective(t SocketType) string {
+	if t == Datagram {
+		return "ListenDatagram"
+	}
+	return "ListenStream"
+}
+
+// the environment variables of the sockets passed by systemd,
+// see https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+const (
+	listenPidEnv     = "LISTEN_PID"
+	listenFdsEnv     = "LISTEN_FDS"
+	listenFdNamesEnv = "LISTEN_FDNAMES"
+	listenFdsStart   = 3
+)
+
+var (
+	listenOnce  sync.Once
+	listenFiles []*os.File
+)
+
+// ListenFiles returns the sockets passed to the process by systemd socket activation, in the order of
+// the socket unit, named by LISTEN_FDNAMES. It's nil if the process hasn't been activated by a socket.
+// The environment variables are unset, so the sockets aren't passed on to the child processes,
+// and the later calls return the same files.
+func ListenFiles() []*os.File {
+	listenOnce.Do(func() {
+		listenFiles = activationFiles(os.Getenv(listenPidEnv), os.Getenv(listenFdsEnv), os.Getenv(listenFdNamesEnv))
+		_ = os.Unsetenv(listenPidEnv)
+		_ = os.Unsetenv(listenFdsEnv)
+		_ = os.Unsetenv(listenFdNamesEnv)
+	})
+	return listenFiles
+}
+
+// activationFiles opens the file descriptors described by the environment if they have been passed to this process
+func activationFiles(pid, fds, names string) []*os.File {
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	fdNames := strings.Split(names, ":")
+	files := make([]*os.File, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		closeOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - listenFdsStart; i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
+
+// Listeners returns the stream sockets passed by systemd socket activation as listeners,
+// it's nil if the process hasn't been activated by a socket
+func Listeners() ([]net.Listener, error) {
+	return FileListeners(ListenFiles())
+}
+
+// PacketConns returns the datagram sockets passed by systemd socket activation
+func PacketConns() ([]net.PacketConn, error) {
+	var conns []net.PacketConn
+	for _, f := range ListenFiles() {
+		if sockType(f) != syscall.SOCK_DGRAM {
+			continue
+		}
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// FileListeners converts the stream sockets among the files into listeners and skips the others,
+// the files stay open. It works on any listening sockets, e.g. the ones of a test.
+func FileListeners(files []*os.File) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range files {
+		if sockType(f) != syscall.SOCK_STREAM {
+			continue
+		}
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// activationHelperEnv makes TestActivationHelper print the sockets it's been passed instead of skipping
+const activationHelperEnv = "DAEMON_ACTIVATION_HELPER"
+
+func listenTCP(t *testing.T) (*net.TCPListener, *os.File) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return l.(*net.TCPListener), f
+}
+
+func listenUDP(t *testing.T) *os.File {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	f, err := conn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+func TestFileListeners(t *testing.T) {
+	l, tcpFile := listenTCP(t)
+	udpFile := listenUDP(t)
+	regular, err := os.CreateTemp(t.TempDir(), "regular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regular.Close()
+
+	listeners, err := FileListeners([]*os.File{udpFile, tcpFile, regular})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("got %d listeners, want only the stream socket", len(listeners))
+	}
+	defer listeners[0].Close()
+	if got, want := listeners[0].Addr().String(), l.Addr().String(); got != want {
+		t.Fatalf("listener address is %s, want %s", got, want)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = accepted.Close()
+}
+
+func TestActivationFilesIgnoresOtherProcesses(t *testing.T) {
+	for _, env := range [][3]string{
+		{"", "1", "web"},
+		{"1", "1", "web"},
+		{fmt.Sprint(os.Getpid() + 1), "1", "web"},
+		{fmt.Sprint(os.Getpid()), "", ""},
+		{fmt.Sprint(os.Getpid()), "0", ""},
+		{fmt.Sprint(os.Getpid()), "x", ""},
+	} {
+		if files := activationFiles(env[0], env[1], env[2]); files != nil {
+			t.Errorf("activationFiles(%q, %q, %q) = %v, want nil", env[0], env[1], env[2], files)
+		}
+	}
+}
+
+// TestActivationHelper runs in the process started by TestActivationFiles, which passes it the sockets
+// the way systemd does
+func TestActivationHelper(t *testing.T) {
+	if os.Getenv(activationHelperEnv) != "1" {
+		t.Skip("only run by TestActivationFiles")
+	}
+	files := ListenFiles()
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	listeners, err := FileListeners(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	fmt.Printf("names=%s listeners=%s env=%s\n", strings.Join(names, ","), strings.Join(addrs, ","), os.Getenv(listenFdsEnv))
+}
+
+func TestActivationFiles(t *testing.T) {
+	l, tcpFile := listenTCP(t)
+	udpFile := listenUDP(t)
+
+	for _, tt := range []struct {
+		pid   string // the shell replaces $$ with the pid of the helper
+		names string
+		want  string
+	}{
+		{"$$", "web:dns", "names=web,dns listeners=" + l.Addr().String() + " env="},
+		// the missing and empty names are numbered by the file descriptor
+		{"$$", "web", "names=web,LISTEN_FD_4 listeners=" + l.Addr().String() + " env="},
+		{"$$", ":dns", "names=LISTEN_FD_3,dns listeners=" + l.Addr().String() + " env="},
+		// the sockets passed to another process, e.g. the parent, are left alone
+		{"1", "web:dns", "names= listeners= env="},
+	} {
+		// exec keeps the pid of the shell, so LISTEN_PID is set like systemd does
+		cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=`+tt.pid+` exec "$0" -test.run=^TestActivationHelper$`, os.Args[0])
+		cmd.Env = append(os.Environ(), activationHelperEnv+"=1", listenFdsEnv+"=2", listenFdNamesEnv+"="+tt.names)
+		cmd.ExtraFiles = []*os.File{tcpFile, udpFile}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if !strings.Contains(string(out), tt.want+"\n") {
+			t.Errorf("LISTEN_PID=%s LISTEN_FDNAMES=%s: got %q, want %q", tt.pid, tt.names, out, tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
+
+// sockType returns the type of the socket, -1 if the file is not a socket
+func sockType(f *os.File) int {
+	t, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return -1
+	}
+	return t
+}
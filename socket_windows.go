@@ -0,0 +1,11 @@
+package daemon
+
+import "os"
+
+// closeOnExec does nothing, systemd doesn't pass sockets on windows
+func closeOnExec(fd int) {}
+
+// sockType returns -1, no file is taken for a passed socket
+func sockType(f *os.File) int {
+	return -1
+}
@@ -1,11 +1,14 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
-	"text/template"
+	"strconv"
+	"time"
 )
 
 type supervisord struct {
@@ -30,36 +33,59 @@ func (s *supervisord) Install() (err error) {
 		return err
 	}
 
-	tpl, err := template.New("supervisordScript").Parse(supervisordScript)
-	if err != nil {
+	if err = createAccount(s.c); err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(s.servicePath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	files, err := s.render(s.c)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	if err := tpl.Execute(file, s.c); err != nil {
-		_ = os.Remove(s.servicePath())
+	if err = writeFiles(files); err != nil {
 		return err
 	}
 
-	if err := s.configLogFile(); err != nil {
-		_ = os.Remove(s.servicePath())
+	// clean up the service files if an error occurs in the next operation
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				_ = os.Remove(f.Path)
+			}
+		}
+	}()
+
+	if err = s.configLogFile(); err != nil {
 		return err
 	}
-
-	if err := exec.Command("supervisorctl", "reread").Run(); err != nil {
-		_ = os.Remove(s.servicePath())
+	if err = createDirs(s.c, false); err != nil {
 		return err
 	}
-	if err := exec.Command("supervisorctl", "add", s.c.Name).Run(); err != nil {
-		_ = os.Remove(s.servicePath())
+	// supervisord appends the output of the event listener to the events log as root
+	if !pathOrFileIsExist(supervisordEventsLog(s.c.Name)) {
+		if err = createLogFile(supervisordEventsLog(s.c.Name), "root", "root"); err != nil {
+			return err
+		}
+	}
+
+	commands := [][]string{{"reread"}}
+	for _, name := range s.processGroups() {
+		commands = append(commands, []string{"add", name})
+	}
+	err = s.ctl(func(ctx context.Context, client *supervisorClient) error {
+		if _, _, _, err := client.reloadConfig(ctx); err != nil {
+			return err
+		}
+		for _, name := range s.processGroups() {
+			if err := client.addProcessGroup(ctx, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, commands...)
+	if err != nil {
 		return err
 	}
-	return nil
+	return s.c.runOnInstall()
 }
 
 func (s *supervisord) Enable() error {
@@ -71,6 +97,11 @@ func (s *supervisord) Disable() error {
 }
 
 func (s *supervisord) Remove() error {
+	return s.RemoveWith(RemoveOptions{})
+}
+
+// RemoveWith uninstalls the service, and deletes the managed directories created by Install if opts.Purge is set
+func (s *supervisord) RemoveWith(opts RemoveOptions) error {
 	if err := checkPrivileges(); err != nil {
 		return err
 	}
@@ -78,10 +109,27 @@ func (s *supervisord) Remove() error {
 		return errNotInstalled
 	}
 	_ = s.Stop()
-	_ = exec.Command("supervisorctl", "remove", s.c.Name).Run()
+	for _, name := range s.processGroups() {
+		name := name
+		_ = s.ctl(func(ctx context.Context, client *supervisorClient) error {
+			return client.removeProcessGroup(ctx, name)
+		}, []string{"stop", name}, []string{"remove", name})
+	}
+	_ = os.Remove(supervisordListenerPath(s.c.Name))
+	_ = os.Remove(supervisordEventsLog(s.c.Name))
 	_ = os.Remove(s.servicePath())
-	_ = exec.Command("supervisorctl", "reread").Run()
-	return nil
+	_ = removeLogRotate(s.c.Name)
+	_ = s.ctl(func(ctx context.Context, client *supervisorClient) error {
+		_, _, _, err := client.reloadConfig(ctx)
+		return err
+	}, []string{"reread"})
+	if err := removeDirs(s.c, opts.Purge); err != nil {
+		return err
+	}
+	if err := deleteAccount(s.c); err != nil {
+		return err
+	}
+	return s.c.runOnRemove()
 }
 
 func (s *supervisord) Start() error {
@@ -97,11 +145,17 @@ func (s *supervisord) Start() error {
 	if err := s.configLogFile(); err != nil {
 		return err
 	}
-
-	if err := exec.Command("supervisorctl", "start", s.c.Name).Run(); err != nil {
+	if err := createDirs(s.c, true); err != nil {
 		return err
 	}
-	return nil
+
+	return s.ctl(func(ctx context.Context, client *supervisorClient) error {
+		err := client.startProcess(ctx, s.program())
+		if isFault(err, faultAlreadyStarted) {
+			return errAlreadyRunning
+		}
+		return err
+	}, []string{"start", s.program()})
 }
 
 func (s *supervisord) Stop() error {
@@ -115,39 +169,60 @@ func (s *supervisord) Stop() error {
 		return errAlreadyStopped
 	}
 
-	if err := exec.Command("supervisorctl", "stop", s.c.Name).Run(); err != nil {
+	return s.ctl(func(ctx context.Context, client *supervisorClient) error {
+		err := client.stopProcess(ctx, s.program())
+		if isFault(err, faultNotRunning) {
+			return errAlreadyStopped
+		}
 		return err
-	}
-	return nil
+	}, []string{"stop", s.program()})
 }
 
-func (s *supervisord) Status() error {
+func (s *supervisord) Restart() error {
 	if err := checkPrivileges(); err != nil {
 		return err
 	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
-	output, err := exec.Command("supervisorctl", "status", s.c.Name).Output()
-	if err == nil {
-		reg := regexp.MustCompile("(STARTING|RUNNING|STOPPED)")
-		stat := reg.FindString(string(output))
-		if stat == "STARTING" {
-			fmt.Println("Service is starting...")
-		} else if stat == "RUNNING" {
-			reg := regexp.MustCompile("pid ([0-9]+)")
-			data := reg.FindStringSubmatch(string(output))
-			if len(data) > 1 {
-				fmt.Println("Service (pid " + data[1] + ") is running")
-			} else {
-				fmt.Println("Service is running")
-			}
-		} else if stat == "STOPPED" {
-			fmt.Println("Service has stopped")
+	if err := s.configLogFile(); err != nil {
+		return err
+	}
+	if err := createDirs(s.c, true); err != nil {
+		return err
+	}
+
+	return s.ctl(func(ctx context.Context, client *supervisorClient) error {
+		if err := client.stopProcess(ctx, s.program()); err != nil && !isFault(err, faultNotRunning) {
+			return err
 		}
-		return nil
+		return client.startProcess(ctx, s.program())
+	}, []string{"restart", s.program()})
+}
+
+func (s *supervisord) Status() error {
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	state, pid, err := s.processState()
+	if err != nil {
+		return err
+	}
+	switch state {
+	case "STARTING", "BACKOFF":
+		fmt.Println("Service is starting...")
+	case "RUNNING":
+		if pid > 0 {
+			fmt.Println("Service (pid " + strconv.Itoa(pid) + ") is running")
+		} else {
+			fmt.Println("Service is running")
+		}
+		printHealth(s.c)
+	case "STOPPING":
+		fmt.Println("Service is stopping...")
+	default:
+		fmt.Println("Service has stopped")
 	}
-	fmt.Println("Service has stopped")
 	return nil
 }
 
@@ -158,13 +233,205 @@ func (s *supervisord) Log() error {
 	if err := s.configLogFile(); err != nil {
 		return err
 	}
-	return execCommandWithOutput("supervisorctl", "tail", "-f", s.c.Name)
+	return followLog(s.Logs)
+}
+
+func (s *supervisord) Logs(ctx context.Context, opts LogOptions) error {
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	channel, err := s.logChannel(opts)
+	if err != nil {
+		return err
+	}
+	if opts.hasTimeFilter() {
+		return errLogFilterUnsupported
+	}
+	if err = s.configLogFile(); err != nil {
+		return err
+	}
+	if client := s.client(); client != nil {
+		// reading nothing checks whether the log can be read over XML-RPC
+		if _, _, err := client.tailLog(ctx, s.program(), channel, 0, 0); !isUnreachable(err) {
+			if err != nil {
+				return err
+			}
+			return s.rpcLogs(ctx, client, opts, channel)
+		}
+	}
+	if opts.Follow {
+		// supervisorctl prints the last 1600 bytes before following, the number of lines can't be chosen
+		return runLogCommand(ctx, opts.writer(), "supervisorctl", s.ctlArgs("tail", "-f", s.program(), channel)...)
+	}
+
+	// supervisorctl tail counts bytes instead of lines, so read enough bytes and keep the last lines
+	size := supervisorTailBytes
+	if opts.Lines > 0 {
+		size = opts.Lines * supervisorLineBytes
+	}
+	out, err := exec.CommandContext(ctx, "supervisorctl", s.ctlArgs("tail", "-"+strconv.Itoa(size), s.program(), channel)...).Output()
+	if err != nil {
+		return err
+	}
+	if opts.Lines <= 0 {
+		_, err = opts.writer().Write(out)
+		return err
+	}
+	last := &lastLinesWriter{n: opts.Lines}
+	_, _ = last.Write(out)
+	return last.flush(opts.writer())
+}
+
+// logChannel returns the channel of the program's log which has the chosen stream
+func (s *supervisord) logChannel(opts LogOptions) (string, error) {
+	if opts.Stream == Stderr {
+		if s.c.StderrLogFile == "" {
+			return "", errNoStderrLog
+		}
+		return "stderr", nil
+	}
+	if s.c.LogOutput.kind != fileOutput {
+		// supervisord sends the other outputs to syslog with its own identifier, they can't be told apart
+		return "", errLogNotReadable
+	}
+	return "stdout", nil
+}
+
+// rpcLogs reads the log over XML-RPC, the number of lines is kept while following unlike supervisorctl tail -f
+func (s *supervisord) rpcLogs(ctx context.Context, client *supervisorClient, opts LogOptions, channel string) error {
+	// the log is read by bytes, so read enough bytes and keep the last lines
+	size := supervisorTailBytes
+	if opts.Lines > 0 {
+		size = opts.Lines * supervisorLineBytes
+	}
+	data, offset, err := client.tailLog(ctx, s.program(), channel, 0, size)
+	if err != nil {
+		return err
+	}
+	if opts.Lines > 0 {
+		last := &lastLinesWriter{n: opts.Lines}
+		_, _ = last.Write([]byte(data))
+		err = last.flush(opts.writer())
+	} else {
+		_, err = opts.writer().Write([]byte(data))
+	}
+	if err != nil || !opts.Follow {
+		return err
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		// reading nothing from the end returns the size of the log
+		_, size, err := client.tailLog(ctx, s.program(), channel, 0, 0)
+		if err == nil && size < offset {
+			// rotated, start over from the beginning of the new log
+			offset = 0
+		}
+		if err == nil && size > offset {
+			data, err = client.readLog(ctx, s.program(), channel, offset, size-offset)
+			offset = size
+		}
+		if err == nil {
+			_, err = opts.writer().Write([]byte(data))
+			data = ""
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to follow the log: %w", err)
+		}
+	}
+}
+
+func (s *supervisord) LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error) {
+	if !s.isInstalled() {
+		return nil, errNotInstalled
+	}
+	if _, err := s.logChannel(opts); err != nil {
+		return nil, err
+	}
+	if err := s.configLogFile(); err != nil {
+		return nil, err
+	}
+	return lineEntries(ctx, s.c.Name, opts, s.Logs)
+}
+
+// instance is only called on the template, which is wrapped by instanceTemplate
+func (s *supervisord) instance(name string) (Daemon, error) {
+	return nil, errNoInstances
+}
+
+func (s *supervisord) Upgrade(newExec string, opts ...UpgradeOptions) error {
+	if err := checkPrivileges(); err != nil {
+		return err
+	}
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	return upgradeExec(s.c, newExec, opts, s.isRunning, s.Restart)
+}
+
+func (s *supervisord) Health(ctx context.Context) error {
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	return checkHealth(ctx, s.c)
+}
+
+// Watch follows the events reported by the event listener of the program
+func (s *supervisord) Watch(ctx context.Context) (<-chan StateEvent, error) {
+	if !s.isInstalled() {
+		return nil, errNotInstalled
+	}
+	return supervisordEvents(ctx, s.c.Name)
+}
+
+func (s *supervisord) Render() ([]Artifact, error) {
+	return s.render(renderConfig(s.c))
+}
+
+func (s *supervisord) render(c *config) ([]Artifact, error) {
+	// the size rotation is written into the ini file even if logrotate isn't used
+	if err := validateRotation(c.Rotation); err != nil {
+		return nil, err
+	}
+	content, err := renderTemplate("supervisordScript", supervisordScript, c)
+	if err != nil {
+		return nil, err
+	}
+	files := []Artifact{{Path: s.servicePath(), Mode: 0644, Content: content}}
+	// the script of the event listener is listed before the ini file which refers to it
+	script, err := renderTemplate("supervisordListener", supervisordListener, c)
+	if err != nil {
+		return nil, err
+	}
+	files = append([]Artifact{{Path: supervisordListenerPath(c.Name), Mode: 0755, Content: script}}, files...)
+	// supervisord only rotates by size, the periodic rotation is done by logrotate
+	if c.Rotation.Period != "" {
+		return renderLogRotateFor(c, files, false)
+	}
+	return files, nil
 }
 
 func (s *supervisord) servicePath() string {
 	return "/etc/supervisor/conf.d/" + s.c.Name + ".ini"
 }
 
+// program is the name used by supervisorctl, group:name once the program has been added to its group
+func (s *supervisord) program() string {
+	if s.c.GroupName != "" && pathOrFileIsExist(supervisordGroupPath(s.c.GroupName)) {
+		return s.c.GroupName + ":" + s.c.Name
+	}
+	return s.c.Name
+}
+
 func (s *supervisord) isInstalled() bool {
 	if _, err := os.Stat(s.servicePath()); err != nil {
 		return false
@@ -173,40 +440,186 @@ func (s *supervisord) isInstalled() bool {
 }
 
 func (s *supervisord) isRunning() bool {
-	output, err := exec.Command("supervisorctl", "status", s.c.Name).Output()
-	if err != nil {
-		return false
+	state, _, err := s.processState()
+	return err == nil && (state == "RUNNING" || state == "STARTING")
+}
+
+// processState returns the state name and the pid of the program, a program unknown to supervisord is STOPPED
+func (s *supervisord) processState() (state string, pid int, err error) {
+	if client := s.client(); client != nil {
+		info, err := client.processInfo(context.Background(), s.program())
+		if isFault(err, faultBadName) {
+			return "STOPPED", 0, nil
+		}
+		if !isUnreachable(err) {
+			return info.StateName, info.PID, err
+		}
+	}
+	// supervisorctl status exits with non-zero codes for the stopped programs, the output is parsed anyway
+	output, err := exec.Command("supervisorctl", s.ctlArgs("status", s.program())...).Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return "", 0, err
+	}
+	state = supervisorStatePattern.FindString(string(output))
+	if state == "" {
+		return "STOPPED", 0, nil
+	}
+	if data := supervisorPidPattern.FindStringSubmatch(string(output)); len(data) > 1 {
+		pid, _ = strconv.Atoi(data[1])
 	}
-	reg := regexp.MustCompile("(RUNNING|STARTING)")
-	return reg.MatchString(string(output))
+	return state, pid, nil
 }
 
-func (s *supervisord) configLogFile() error {
-	logPath := "/var/log/" + s.c.Name + "/"
-	logFile := logPath + s.c.Name + ".log"
-	if pathOrFileIsExist(logFile) {
-		return nil
+var (
+	supervisorStatePattern = regexp.MustCompile("STARTING|RUNNING|BACKOFF|STOPPING|STOPPED|EXITED|FATAL|UNKNOWN")
+	supervisorPidPattern   = regexp.MustCompile("pid ([0-9]+)")
+)
+
+// client returns the XML-RPC client of supervisord, nil if there is no server to talk to
+func (s *supervisord) client() *supervisorClient {
+	return newSupervisorClient(s.c.SupervisorServer)
+}
+
+// ctl runs op over XML-RPC, or the supervisorctl commands one by one if supervisord can't be reached that way
+func (s *supervisord) ctl(op func(ctx context.Context, client *supervisorClient) error, commands ...[]string) error {
+	return supervisorCall(s.c.SupervisorServer, op, commands...)
+}
+
+func (s *supervisord) ctlArgs(args ...string) []string {
+	return supervisorctlArgs(s.c.SupervisorServer, args...)
+}
+
+// processGroups are the process groups added by Install, the program and its event listener,
+// a member of a Group is added by Group.Install together with the group section
+func (s *supervisord) processGroups() []string {
+	if s.c.GroupName != "" {
+		return []string{s.c.Name + "-events"}
+	}
+	return []string{s.c.Name, s.c.Name + "-events"}
+}
+
+// supervisordUpdate applies the changes of the config files like supervisorctl update
+func supervisordUpdate(server string) error {
+	return supervisorCall(server, func(ctx context.Context, client *supervisorClient) error {
+		return client.update(ctx)
+	}, []string{"update"})
+}
+
+func supervisorCall(server string, op func(ctx context.Context, client *supervisorClient) error, commands ...[]string) error {
+	if client := newSupervisorClient(server); client != nil {
+		if err := op(context.Background(), client); !isUnreachable(err) {
+			return err
+		}
 	}
-	if !pathOrFileIsExist(logPath) {
-		if err := os.MkdirAll(logPath, 0755); err != nil {
+	for _, args := range commands {
+		if err := exec.Command("supervisorctl", supervisorctlArgs(server, args...)...).Run(); err != nil {
 			return err
 		}
 	}
-	file, err := os.Create(logFile)
-	if err != nil {
-		return err
+	return nil
+}
+
+// supervisorctlArgs points supervisorctl to the server set by WithSupervisorServer
+func supervisorctlArgs(server string, args ...string) []string {
+	u, err := url.Parse(server)
+	if server == "" || err != nil {
+		return args
 	}
-	return file.Close()
+	var opts []string
+	if u.User != nil {
+		opts = append(opts, "-u", u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			opts = append(opts, "-p", password)
+		}
+		u.User = nil
+	}
+	return append(append([]string{"-s", u.String()}, opts...), args...)
+}
+
+func (s *supervisord) configLogFile() error {
+	return prepareLogFile(s.c)
 }
 
-var supervisordScript = `[program:{{.Name}}]
-directory={{.WorkDir}}
-command={{.Exec}} {{.Args}}
+var supervisordScript = `[program:{{safeName .Name}}]
+user={{iniValue .User}}
+directory={{iniValue .WorkDir}}
+{{- with dirSettings .}}
+environment={{range $i, $d := .}}{{if $i}},{{end}}{{$d.Env}}={{iniValue (shellQuote $d.Path)}}{{end}}
+{{- end}}
+{{- if .Hooks.PreStart}}
+command={{iniHookCommand .Hooks.PreStart .Exec .Args}}
+{{- else}}
+command={{iniCommand .Exec .Args}}
+{{- end}}
 autostart=true
+{{- if .Priority}}
+priority={{.Priority}}
+{{- end}}
 autorestart=unexpected
 exitcodes=0
+{{- if .StderrLogFile}}
+redirect_stderr=false
+stderr_logfile_maxbytes={{.Rotation.MaxSize}}
+stderr_logfile_backups={{.Rotation.Keep}}
+stderr_logfile={{iniValue .StderrLogFile}}
+{{- else}}
 redirect_stderr=true
-stdout_logfile_maxbytes=50MB
-stdout_logfile_backups=10
-stdout_logfile={{.LogFile}}
+{{- end}}
+{{- if eq (logKind .LogOutput) "file"}}
+stdout_logfile_maxbytes={{.Rotation.MaxSize}}
+stdout_logfile_backups={{.Rotation.Keep}}
+stdout_logfile={{iniValue .LogFile}}
+{{- else if eq (logKind .LogOutput) "null"}}
+stdout_logfile=NONE
+{{- else}}
+stdout_logfile=syslog
+{{- end}}
+
+[eventlistener:{{safeName .Name}}-events]
+user={{iniValue .User}}
+directory={{iniValue .WorkDir}}
+command={{iniValue (listenerPath .Name)}}
+events=PROCESS_STATE
+autostart=true
+autorestart=true
+stderr_logfile={{iniValue (eventsLog .Name)}}
+`
+
+// supervisordListenerPath is the event listener script which reports the state changes of the program and runs its hooks
+func supervisordListenerPath(name string) string {
+	return "/etc/supervisor/conf.d/" + name + ".events.sh"
+}
+
+// supervisordListener speaks the event listener protocol of supervisord, it runs the hooks except PreStart,
+// which is part of the command of the program. Stdout is the protocol channel,
+// so the events and the output of the hooks go to stderr, which supervisord writes to the events log read by Watch.
+var supervisordListener = `#! /bin/sh
+# reports the state changes of the {{commentValue .Name}} program and runs its hooks, written by daemon
+hook() {
+    sh -c "$1" >&2
+}
+while :; do
+    printf 'READY\n'
+    read -r header || exit 0
+    len=$(echo "$header" | sed -n 's/.*len:\([0-9]*\).*/\1/p')
+    event=$(echo "$header" | sed -n 's/.*eventname:\([A-Z_]*\).*/\1/p')
+    payload=$(head -c "$len")
+    case "$payload" in
+    "processname:"{{shellValue .Name}}" "*)
+        printf 'event %s %s\n' "$event" "$payload" >&2
+        case "$event" in
+{{- with .Hooks.PostStart}}
+        PROCESS_STATE_RUNNING) hook {{shellHook $ .}} ;;
+{{- end}}
+{{- with .Hooks.PreStop}}
+        PROCESS_STATE_STOPPING) hook {{shellHook $ .}} ;;
+{{- end}}
+{{- with .Hooks.PostStop}}
+        PROCESS_STATE_STOPPED|PROCESS_STATE_EXITED|PROCESS_STATE_FATAL) hook {{shellHook $ .}} ;;
+{{- end}}
+        esac
+        ;;
+    esac
+    printf 'RESULT 2\nOK'
+done
 `
@@ -1,12 +1,13 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"text/template"
 )
 
 type systemd struct {
@@ -27,37 +28,71 @@ func (s *systemd) Install() (err error) {
 		return errAlreadyInstalled
 	}
 
-	if s.c.Exec, err = executablePath(s.c.Exec); err != nil {
-		return err
+	// the instances share the template unit, which is installed with the first one
+	if s.c.Instance == "" || !pathOrFileIsExist(s.servicePath()) {
+		var files []Artifact
+		if files, err = s.installFiles(); err != nil {
+			return err
+		}
+		// clean up the service files if an error occurs in the next operation
+		defer func() {
+			if err != nil {
+				for _, f := range files {
+					_ = os.Remove(f.Path)
+				}
+			}
+		}()
 	}
 
-	tpl, err := template.New("systemdScript").Parse(systemdScript)
-	if err != nil {
-		return err
+	// the log files of a template are created for each instance
+	if !s.c.isTemplate() {
+		if err = prepareLogFile(s.c); err != nil {
+			return err
+		}
 	}
 
-	file, err := os.OpenFile(s.servicePath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
+	if err = withSystemBus(func(bus *busConn) error {
+		return bus.reload()
+	}, systemctl("daemon-reload")); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	if err := tpl.Execute(file, s.c); err != nil {
-		_ = os.Remove(s.servicePath())
-		return err
+	// a template unit is only enabled for its instances
+	if !s.c.isTemplate() {
+		if err = withSystemBus(func(bus *busConn) error {
+			return bus.enableUnitFiles(s.activationUnit())
+		}, systemctl("enable", s.activationUnit())); err != nil {
+			return err
+		}
 	}
 
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
-		_ = os.Remove(s.servicePath())
-		return err
+	return s.c.runOnInstall()
+}
+
+// installFiles creates the account and writes the unit file, it returns the written files
+func (s *systemd) installFiles() (files []Artifact, err error) {
+	c := s.c.templateConfig()
+	if c.Exec, err = executablePath(c.Exec); err != nil {
+		return nil, err
 	}
 
-	if err := exec.Command("systemctl", "enable", s.c.Name+".service").Run(); err != nil {
-		_ = os.Remove(s.servicePath())
-		return err
+	if !c.dynamicUser() {
+		if err = createAccount(c); err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	if files, err = s.render(c); err != nil {
+		return nil, err
+	}
+	if err = writeFiles(files); err != nil {
+		return nil, err
+	}
+	// systemd creates the managed directories on start, the missing ones are recorded for Remove
+	if err = recordDirs(c, missingDirs(c)); err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
 func (s *systemd) Enable() error {
@@ -69,6 +104,11 @@ func (s *systemd) Disable() error {
 }
 
 func (s *systemd) Remove() error {
+	return s.RemoveWith(RemoveOptions{})
+}
+
+// RemoveWith uninstalls the service, and deletes the managed directories created by Install if opts.Purge is set
+func (s *systemd) RemoveWith(opts RemoveOptions) error {
 	if err := checkPrivileges(); err != nil {
 		return err
 	}
@@ -76,19 +116,59 @@ func (s *systemd) Remove() error {
 		return errNotInstalled
 	}
 
-	_ = s.Stop()
+	// an instance leaves the template unit and the shared files to the other instances
+	if s.c.Instance != "" {
+		_ = s.Stop()
+		_ = s.disable(s.unit())
+		return s.c.runOnRemove()
+	}
 
-	_ = exec.Command("systemctl", "disable", s.c.Name+".service").Run()
+	if s.c.isTemplate() {
+		_ = exec.Command("systemctl", "stop", s.c.Name+"@*.service").Run()
+		s.disableInstances()
+	} else {
+		_ = s.Stop()
+		_ = s.disable(s.activationUnit())
+	}
 
 	_ = os.Remove(s.servicePath())
+	if s.c.Schedule != nil {
+		_ = os.Remove(s.timerPath())
+	}
+	if len(s.c.Sockets) > 0 {
+		_ = os.Remove(s.socketPath())
+	}
 
-	return nil
+	_ = removeLogRotate(s.c.Name)
+
+	if err := removeDirs(s.c, opts.Purge); err != nil {
+		return err
+	}
+
+	if !s.c.dynamicUser() {
+		if err := deleteAccount(s.c); err != nil {
+			return err
+		}
+	}
+
+	return s.c.runOnRemove()
+}
+
+// disableInstances removes the links of the enabled instances, which would be left dangling by removing the template
+func (s *systemd) disableInstances() {
+	links, _ := filepath.Glob("/etc/systemd/system/*.wants/" + s.c.Name + "@*.service")
+	for _, link := range links {
+		_ = os.Remove(link)
+	}
 }
 
 func (s *systemd) Start() error {
 	if err := checkPrivileges(); err != nil {
 		return err
 	}
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
@@ -96,17 +176,16 @@ func (s *systemd) Start() error {
 		return errAlreadyRunning
 	}
 
-	if err := exec.Command("systemctl", "start", s.c.Name).Run(); err != nil {
-		return err
-	}
-
-	return nil
+	return s.runJob("StartUnit", "start", s.activationUnit())
 }
 
 func (s *systemd) Stop() error {
 	if err := checkPrivileges(); err != nil {
 		return err
 	}
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
@@ -114,85 +193,459 @@ func (s *systemd) Stop() error {
 		return errAlreadyStopped
 	}
 
-	if err := exec.Command("systemctl", "stop", s.c.Name).Run(); err != nil {
+	// stopping a timer or a socket leaves the service which is running, so both are stopped
+	if unit := s.activationUnit(); unit != s.unit() {
+		if err := s.runJob("StopUnit", "stop", unit); err != nil {
+			return err
+		}
+	}
+	return s.runJob("StopUnit", "stop", s.unit())
+}
+
+func (s *systemd) Restart() error {
+	if err := checkPrivileges(); err != nil {
 		return err
 	}
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
 
-	return nil
+	// a socket stays open while the service restarts, so no connection is refused
+	unit := s.activationUnit()
+	if len(s.c.Sockets) > 0 {
+		unit = s.unit()
+	}
+	return s.runJob("RestartUnit", "restart", unit)
 }
 
 func (s *systemd) Status() error {
-	if err := checkPrivileges(); err != nil {
-		return err
+	if s.c.isTemplate() {
+		return errInstanceRequired
 	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
-	output, err := exec.Command("systemctl", "status", s.c.Name+".service").Output()
-	if err == nil {
-		if matched, err := regexp.MatchString("Active: active", string(output)); err == nil && matched {
-			reg := regexp.MustCompile("Main PID: ([0-9]+)")
-			data := reg.FindStringSubmatch(string(output))
-			if len(data) > 1 {
-				fmt.Println("Service (pid " + data[1] + ") is running")
-			} else {
-				fmt.Println("Service is running")
-			}
-			return nil
+	if s.c.Schedule != nil {
+		return s.timerStatus()
+	}
+	props, err := s.properties(s.unit())
+	if err != nil {
+		return err
+	}
+	if props.ActiveState == "active" || props.ActiveState == "reloading" {
+		if props.MainPID > 0 {
+			fmt.Println("Service (pid " + strconv.Itoa(props.MainPID) + ") is running")
+		} else {
+			fmt.Println("Service is running")
 		}
+		printHealth(s.c)
+		return nil
 	}
 	fmt.Println("Service has stopped")
 	return nil
 }
 
 func (s *systemd) Log() error {
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
 	fmt.Println("==> Press Ctrl-C to exit <==")
-	return execCommandWithOutput("journalctl", "-fu", s.c.Name)
+	return followLog(s.Logs)
+}
+
+func (s *systemd) Logs(ctx context.Context, opts LogOptions) error {
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	if opts.Stream == Stderr {
+		return fileLogs(ctx, s.c, opts)
+	}
+	switch s.c.LogOutput.kind {
+	case fileOutput:
+		return fileLogs(ctx, s.c, opts)
+	case nullOutput:
+		return errLogNotReadable
+	}
+	args := append([]string{"-u", s.unit()}, opts.journalArgs()...)
+	return runLogCommand(ctx, opts.writer(), "journalctl", args...)
+}
+
+func (s *systemd) LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error) {
+	if s.c.isTemplate() {
+		return nil, errInstanceRequired
+	}
+	if !s.isInstalled() {
+		return nil, errNotInstalled
+	}
+	if opts.Stream == Stderr {
+		return fileEntries(ctx, s.c, opts, s.Logs)
+	}
+	switch s.c.LogOutput.kind {
+	case fileOutput:
+		return fileEntries(ctx, s.c, opts, s.Logs)
+	case nullOutput:
+		return nil, errLogNotReadable
+	}
+	return journalEntries(ctx, s.unit(), opts)
+}
+
+func (s *systemd) Upgrade(newExec string, opts ...UpgradeOptions) error {
+	if err := checkPrivileges(); err != nil {
+		return err
+	}
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	// the instances share the executable, the other ones run it on their next restart
+	return upgradeExec(s.c, newExec, opts, s.isRunning, s.Restart)
+}
+
+func (s *systemd) Health(ctx context.Context) error {
+	if s.c.isTemplate() {
+		return errInstanceRequired
+	}
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	return checkHealth(ctx, s.c)
+}
+
+// Watch polls the state of the service unit, a template has no state of its own, so an instance must be chosen
+func (s *systemd) Watch(ctx context.Context) (<-chan StateEvent, error) {
+	if s.c.isTemplate() {
+		return nil, errInstanceRequired
+	}
+	if !s.isInstalled() {
+		return nil, errNotInstalled
+	}
+	return pollStates(ctx, s.c.serviceName(), s.state)
+}
+
+func (s *systemd) Render() ([]Artifact, error) {
+	return s.render(renderConfig(s.c.templateConfig()))
+}
+
+func (s *systemd) instance(name string) (Daemon, error) {
+	c, err := s.c.forInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	return &systemd{c}, nil
+}
+
+func (s *systemd) render(c *config) ([]Artifact, error) {
+	content, err := renderTemplate("systemdScript", systemdScript, c)
+	if err != nil {
+		return nil, err
+	}
+	files := []Artifact{{Path: s.servicePath(), Mode: 0644, Content: content}}
+	if c.Schedule != nil {
+		timer, err := renderTemplate("systemdTimer", systemdTimer, c)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, Artifact{Path: s.timerPath(), Mode: 0644, Content: timer})
+	}
+	if len(c.Sockets) > 0 {
+		socket, err := renderTemplate("systemdSocket", systemdSocket, c)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, Artifact{Path: s.socketPath(), Mode: 0644, Content: socket})
+	}
+	// the journal is rotated by journald, the log files need logrotate
+	return renderLogRotateFor(c, files, true)
 }
 
 func (s *systemd) servicePath() string {
+	if s.c.Instances {
+		return "/etc/systemd/system/" + s.c.Name + "@.service"
+	}
 	return "/etc/systemd/system/" + s.c.Name + ".service"
 }
 
+// unit is the name of the managed unit, name@instance.service for an instance
+func (s *systemd) unit() string {
+	return s.c.serviceName() + ".service"
+}
+
+// activationUnit is the unit which is enabled and started, the timer of a scheduled job
+// or the socket of a socket activated service
+func (s *systemd) activationUnit() string {
+	if s.c.Schedule != nil {
+		return s.c.serviceName() + ".timer"
+	}
+	if len(s.c.Sockets) > 0 {
+		return s.c.serviceName() + ".socket"
+	}
+	return s.unit()
+}
+
+func (s *systemd) socketPath() string {
+	return "/etc/systemd/system/" + s.c.Name + ".socket"
+}
+
+func (s *systemd) timerPath() string {
+	return "/etc/systemd/system/" + s.c.Name + ".timer"
+}
+
+// systemdShow reads the properties of the unit by systemctl show
+func systemdShow(unit string, names ...string) (map[string]string, error) {
+	args := []string{"show", unit}
+	for _, name := range names {
+		args = append(args, "-p", name)
+	}
+	output, err := exec.Command("systemctl", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			props[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	return props, nil
+}
+
+// state maps the state of the service unit to the states reported by Watch
+func (s *systemd) state() (stateSample, error) {
+	props, err := s.properties(s.unit())
+	if err != nil {
+		return stateSample{}, err
+	}
+	code := -1
+	// ExecMainCode is CLD_EXITED if the process exited by itself instead of being killed by a signal
+	if props.ExecMainCode == 1 {
+		code = props.ExecMainStatus
+	}
+	switch props.ActiveState {
+	case "activating":
+		if props.SubState == "auto-restart" {
+			return stateSample{Restarting, code}, nil
+		}
+		return stateSample{Starting, -1}, nil
+	case "active", "reloading", "deactivating":
+		return stateSample{Running, -1}, nil
+	case "failed":
+		return stateSample{Exited, code}, nil
+	}
+	// a job is inactive once it has run, a service once it's stopped
+	if s.c.Schedule != nil && props.ExecMainCode != 0 {
+		return stateSample{Exited, code}, nil
+	}
+	return stateSample{Stopped, -1}, nil
+}
+
+// timerStatus prints whether the timer is armed and when the job runs next and ran last
+func (s *systemd) timerStatus() error {
+	props, err := systemdShow(s.activationUnit(), "ActiveState", "NextElapseUSecRealtime", "LastTriggerUSec")
+	if err != nil {
+		return err
+	}
+	next, last := props["NextElapseUSecRealtime"], props["LastTriggerUSec"]
+	if next == "" {
+		next = "n/a"
+	}
+	if last == "" {
+		last = "never"
+	}
+	if props["ActiveState"] == "active" {
+		fmt.Printf("Timer is active, next run: %s, last run: %s\n", next, last)
+	} else {
+		fmt.Printf("Timer has stopped, last run: %s\n", last)
+	}
+	return nil
+}
+
 func (s *systemd) isInstalled() bool {
 	if _, err := os.Stat(s.servicePath()); err != nil {
 		return false
 	}
+	// the template unit is shared, an instance is installed once it's enabled
+	if s.c.Instance != "" {
+		return withSystemBus(func(bus *busConn) error {
+			state, err := bus.unitFileState(s.unit())
+			if err == nil && state != "enabled" && state != "enabled-runtime" {
+				return errNotInstalled
+			}
+			return err
+		}, systemctl("is-enabled", "--quiet", s.unit())) == nil
+	}
 	return true
 }
 
 func (s *systemd) isRunning() bool {
-	output, err := exec.Command("systemctl", "is-active", s.c.Name+".service").Output()
+	props, err := s.properties(s.activationUnit())
+	return err == nil && (props.ActiveState == "active" || props.ActiveState == "reloading")
+}
+
+// properties reads the properties of the unit over D-Bus, or by systemctl show if the system bus can't be reached
+func (s *systemd) properties(unit string) (props unitProperties, err error) {
+	err = withSystemBus(func(bus *busConn) error {
+		props, err = bus.unitProperties(unit)
+		return err
+	}, func() error {
+		show, err := systemdShow(unit, "ActiveState", "SubState", "MainPID", "ExecMainCode", "ExecMainStatus", "NRestarts")
+		if err != nil {
+			return err
+		}
+		props.ActiveState, props.SubState = show["ActiveState"], show["SubState"]
+		props.MainPID, _ = strconv.Atoi(show["MainPID"])
+		props.ExecMainCode, _ = strconv.Atoi(show["ExecMainCode"])
+		props.ExecMainStatus, _ = strconv.Atoi(show["ExecMainStatus"])
+		props.NRestarts, _ = strconv.Atoi(show["NRestarts"])
+		return nil
+	})
+	return props, err
+}
+
+// runJob queues the job of the unit by the method of the manager, or by systemctl with the command,
+// and waits until it's done. A unit which has failed to start fails the job.
+func (s *systemd) runJob(method, command, unit string) error {
+	return withSystemBus(func(bus *busConn) error {
+		if err := bus.runJob(method, unit); err != nil {
+			return err
+		}
+		if method == "StopUnit" {
+			return nil
+		}
+		props, err := bus.unitProperties(unit)
+		if err == nil && props.ActiveState == "failed" {
+			return errUnitFailed
+		}
+		return err
+	}, systemctl(command, unit))
+}
+
+func (s *systemd) disable(unit string) error {
+	return withSystemBus(func(bus *busConn) error {
+		return bus.disableUnitFiles(unit)
+	}, systemctl("disable", unit))
+}
+
+// withSystemBus runs op over D-Bus, or fallback if the system bus can't be reached. Once a call of op
+// is written systemd may run it, so a later error of the connection, such as a timeout, is returned
+// instead of running the operation again by systemctl.
+func withSystemBus(op func(bus *busConn) error, fallback func() error) error {
+	bus, err := dialSystemBus()
 	if err == nil {
-		reg := regexp.MustCompile("active")
-		return reg.MatchString(strings.ToLower(string(output)))
+		err = op(bus)
+		_ = bus.Close()
+		if bus.sent || !isBusUnreachable(err) {
+			return err
+		}
+	}
+	return fallback()
+}
+
+// systemctl is the fallback which runs systemctl with the arguments
+func systemctl(args ...string) func() error {
+	return func() error {
+		return exec.Command("systemctl", args...).Run()
 	}
-	return false
 }
 
 var systemdScript = `[Unit]
-Description={{.Description}}
-{{- $deps := "network-online.target local-fs.target time-sync.target nss-lookup.target"}}
-{{- if .Dependencies}}
-{{$deps = .Dependencies}}
+Description={{systemdValue .Description | keepInstance .Instances}}
+{{- $instance := ""}}
+{{- if .Instances}}{{$instance = "@%i"}}{{end}}
+{{- range systemdDeps .}}
+{{.Directive}}={{systemdValue .Names}}
 {{- end}}
-Requires={{$deps}}
-After={{$deps}}
 
 [Service]
-User={{.User}}
+User={{systemdValue .User}}
+Group={{systemdValue .Group}}
+{{- if and .CreateUser .CreateUser.Dynamic}}
+DynamicUser=yes
+{{- end}}
 StartLimitInterval=5
 StartLimitBurst=10
-WorkingDirectory={{.WorkDir}}
-PIDFile=/var/run/{{.Name}}.pid
-ExecStartPre=/bin/rm -f /var/run/{{.Name}}.pid
-ExecStart={{.Exec}} {{.Args}}
+WorkingDirectory={{systemdValue .WorkDir}}
+{{- range dirSettings .}}
+{{.Directive}}={{systemdDir .Name}}
+{{- end}}
+{{- if .Schedule}}
+Type=oneshot
+{{- else}}
+PIDFile=/var/run/{{systemdValue .Name}}{{$instance}}.pid
+ExecStartPre=/bin/rm -f /var/run/{{systemdValue .Name}}{{$instance}}.pid
+{{- end}}
+{{- with .Hooks.PreStart}}
+ExecStartPre={{systemdHook . | keepInstance $.Instances}}
+{{- end}}
+ExecStart={{systemdExec .Exec .Args | keepInstance .Instances}}
+{{- with .Hooks.PostStart}}
+ExecStartPost={{systemdHook . | keepInstance $.Instances}}
+{{- end}}
+{{- with .Hooks.PreStop}}
+ExecStop={{systemdHook . | keepInstance $.Instances}}
+{{- end}}
+{{- with .Hooks.PostStop}}
+ExecStopPost={{systemdHook . | keepInstance $.Instances}}
+{{- end}}
+{{- if eq (logKind .LogOutput) "file"}}
+StandardOutput=append:{{systemdValue .LogFile | keepInstance .Instances}}
+{{- else if eq (logKind .LogOutput) "syslog"}}
+StandardOutput=journal
+SyslogIdentifier={{systemdValue .Name}}{{$instance}}
+SyslogFacility={{logFacility .LogOutput}}
+{{- else if eq (logKind .LogOutput) "null"}}
+StandardOutput=null
+{{- end}}
+{{- if .StderrLogFile}}
+StandardError=append:{{systemdValue .StderrLogFile | keepInstance .Instances}}
+{{- end}}
+{{- if not .Schedule}}
 Restart=on-failure
 RestartSec=30
+{{- end}}
+{{- if not (or .Schedule .Sockets)}}
 
 [Install]
 WantedBy=default.target
+{{- end}}
+`
+
+var systemdSocket = `[Unit]
+Description=sockets of {{systemdValue .Name}}
+
+[Socket]
+{{- range .Sockets}}
+{{listenDirective .Type}}={{systemdValue .Address}}
+{{- end}}
+Service={{systemdValue .Name}}.service
+
+[Install]
+WantedBy=sockets.target
+`
+
+var systemdTimer = `[Unit]
+Description=run {{systemdValue .Name}} on schedule
+
+[Timer]
+{{- if .Schedule.OnCalendar}}
+OnCalendar={{systemdValue .Schedule.OnCalendar}}
+Persistent=true
+{{- else}}
+OnBootSec={{timerSpan .Schedule.Every}}
+OnUnitActiveSec={{timerSpan .Schedule.Every}}
+{{- end}}
+Unit={{systemdValue .Name}}.service
+
+[Install]
+WantedBy=timers.target
 `
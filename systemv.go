@@ -1,12 +1,11 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
 	"regexp"
-	"text/template"
 )
 
 type systemv struct {
@@ -32,35 +31,37 @@ func (s *systemv) Install() (err error) {
 		return err
 	}
 
-	tpl, err := template.New("systemvScript").Parse(systemvScript)
-	if err != nil {
+	if err = createAccount(s.c); err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(s.servicePath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	files, err := s.render(s.c)
 	if err != nil {
 		return err
 	}
-	// clean up the service file if an error occurs in the next operation
+	if err = writeFiles(files); err != nil {
+		return err
+	}
+	// clean up the service files if an error occurs in the next operation
 	defer func() {
 		if err != nil {
-			_ = os.Remove(s.servicePath())
+			for _, f := range files {
+				_ = os.Remove(f.Path)
+			}
 		}
 	}()
-	defer file.Close()
 
-	if err = tpl.Execute(file, s.c); err != nil {
+	if err = s.configLogFile(); err != nil {
 		return err
 	}
-
-	if err = s.configLogRoate(); err != nil {
+	if err = createDirs(s.c, false); err != nil {
 		return err
 	}
 
 	if err = s.enable(); err != nil {
 		return err
 	}
-	return
+	return s.c.runOnInstall()
 }
 
 func (s *systemv) Enable() (err error) {
@@ -113,7 +114,12 @@ func (s *systemv) disable() error {
 	return nil
 }
 
-func (s *systemv) Remove() (err error) {
+func (s *systemv) Remove() error {
+	return s.RemoveWith(RemoveOptions{})
+}
+
+// RemoveWith uninstalls the service, and deletes the managed directories created by Install if opts.Purge is set
+func (s *systemv) RemoveWith(opts RemoveOptions) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("failed to remove service: %w", err)
@@ -134,10 +140,16 @@ func (s *systemv) Remove() (err error) {
 	if err = os.Remove(s.servicePath()); err != nil {
 		return err
 	}
-	if err = s.removeLogRoateConf(); err != nil {
+	if err = removeLogRotate(s.c.Name); err != nil {
 		return err
 	}
-	return
+	if err = removeDirs(s.c, opts.Purge); err != nil {
+		return err
+	}
+	if err = deleteAccount(s.c); err != nil {
+		return err
+	}
+	return s.c.runOnRemove()
 }
 
 func (s *systemv) Start() (err error) {
@@ -146,6 +158,9 @@ func (s *systemv) Start() (err error) {
 			err = fmt.Errorf("failed to start service: %w", err)
 		}
 	}()
+	if err = checkPrivileges(); err != nil {
+		return err
+	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
@@ -155,6 +170,9 @@ func (s *systemv) Start() (err error) {
 	if err = s.configLogFile(); err != nil {
 		return err
 	}
+	if err = createDirs(s.c, true); err != nil {
+		return err
+	}
 
 	if err = exec.Command("service", s.c.Name, "start").Run(); err != nil {
 		return err
@@ -168,6 +186,9 @@ func (s *systemv) Stop() (err error) {
 			err = fmt.Errorf("failed to stop service: %w", err)
 		}
 	}()
+	if err = checkPrivileges(); err != nil {
+		return err
+	}
 	if !s.isInstalled() {
 		return errNotInstalled
 	}
@@ -188,6 +209,31 @@ func (s *systemv) stop() (err error) {
 	return
 }
 
+func (s *systemv) Restart() (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("failed to restart service: %w", err)
+		}
+	}()
+	if err = checkPrivileges(); err != nil {
+		return err
+	}
+	if !s.isInstalled() {
+		return errNotInstalled
+	}
+	if err = s.configLogFile(); err != nil {
+		return err
+	}
+	if err = createDirs(s.c, true); err != nil {
+		return err
+	}
+
+	if err = exec.Command("service", s.c.Name, "restart").Run(); err != nil {
+		return err
+	}
+	return
+}
+
 func (s *systemv) Status() (err error) {
 	defer func() {
 		if err != nil {
@@ -215,6 +261,7 @@ func (s *systemv) Status() (err error) {
 		} else {
 			fmt.Println("service is running")
 		}
+		printHealth(s.c)
 	} else {
 		fmt.Println(string(output))
 	}
@@ -234,125 +281,130 @@ func (s *systemv) Log() (err error) {
 		return err
 	}
 	fmt.Println("==> Press Ctrl-C to exit <==")
-	_ = execCommandWithOutput("tail", "-f", s.c.LogFile)
-	return
+	return followLog(s.Logs)
 }
 
-func (s *systemv) servicePath() string {
-	return "/etc/init.d/" + s.c.Name
-}
-
-func (s *systemv) isInstalled() bool {
-	if _, err := os.Stat(s.servicePath()); err != nil {
-		return false
+func (s *systemv) Logs(ctx context.Context, opts LogOptions) error {
+	if !s.isInstalled() {
+		return errNotInstalled
 	}
-	return true
-}
-
-func (s *systemv) isRunning() bool {
-	output, err := exec.Command("service", s.c.Name, "status").Output()
-	if err == nil {
-		if matched, err := regexp.MatchString(s.c.Name, string(output)); err == nil && matched {
-			return true
+	if opts.Stream == Stderr || s.c.LogOutput.kind == fileOutput {
+		if err := s.configLogFile(); err != nil {
+			return err
 		}
+		return fileLogs(ctx, s.c, opts)
 	}
-	return false
+	switch s.c.LogOutput.kind {
+	case nullOutput:
+		return errLogNotReadable
+	}
+	return syslogLogs(ctx, s.c, opts)
 }
 
-func (s *systemv) configLogFile() (err error) {
-	if pathOrFileIsExist(s.c.LogFile) {
-		return
+func (s *systemv) LogEntries(ctx context.Context, opts LogOptions) (<-chan LogEntry, error) {
+	if !s.isInstalled() {
+		return nil, errNotInstalled
 	}
-	logPath := path.Dir(s.c.LogFile)
-	if !pathOrFileIsExist(logPath) {
-		if err = os.MkdirAll(logPath, 0755); err != nil {
-			return err
+	if opts.Stream == Stderr || s.c.LogOutput.kind == fileOutput {
+		if err := s.configLogFile(); err != nil {
+			return nil, err
 		}
-		defer func() {
-			if err != nil {
-				_ = os.Remove(logPath)
-			}
-		}()
+		return fileEntries(ctx, s.c, opts, s.Logs)
 	}
-
-	file, err := os.Create(s.c.LogFile)
-	if err != nil {
-		return err
+	if s.c.LogOutput.kind == nullOutput {
+		return nil, errLogNotReadable
 	}
-	defer file.Close()
-	return
+	return syslogEntries(ctx, s.c, opts)
 }
 
-func (s *systemv) configLogRoate() (err error) {
-	if err = s.configLogFile(); err != nil {
+// instance is only called on the template, which is wrapped by instanceTemplate
+func (s *systemv) instance(name string) (Daemon, error) {
+	return nil, errNoInstances
+}
+
+func (s *systemv) Upgrade(newExec string, opts ...UpgradeOptions) error {
+	if err := checkPrivileges(); err != nil {
 		return err
 	}
-	if err = exec.Command("chown", "-R", s.c.User+":"+s.c.Group, path.Dir(s.c.LockFile)).Run(); err != nil {
-		return err
+	if !s.isInstalled() {
+		return errNotInstalled
 	}
-	tpl, err := template.New("logRoateConf").Parse(logRoateConf)
-	if err != nil {
-		return err
+	return upgradeExec(s.c, newExec, opts, s.isRunning, s.Restart)
+}
+
+func (s *systemv) Health(ctx context.Context) error {
+	if !s.isInstalled() {
+		return errNotInstalled
 	}
+	return checkHealth(ctx, s.c)
+}
 
-	logrotateConfPath := "/etc/logrotate.d/" + s.c.Name
-	file, err := os.OpenFile(logrotateConfPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+// Watch polls the pid file written by the init script and the process in /proc
+func (s *systemv) Watch(ctx context.Context) (<-chan StateEvent, error) {
+	if !s.isInstalled() {
+		return nil, errNotInstalled
+	}
+	return pollStates(ctx, s.c.Name, func() (stateSample, error) {
+		return pidFileState(s.c.PidFile, s.c.LockFile)
+	})
+}
+
+func (s *systemv) Render() ([]Artifact, error) {
+	return s.render(renderConfig(s.c))
+}
+
+func (s *systemv) render(c *config) ([]Artifact, error) {
+	script, err := renderTemplate("systemvScript", systemvScript, c)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			_ = os.Remove(logrotateConfPath)
-		}
-	}()
-	defer file.Close()
+	files := []Artifact{{Path: s.servicePath(), Mode: 0755, Content: script}}
+	return renderLogRotateFor(c, files, true)
+}
 
-	if err = tpl.Execute(file, s.c); err != nil {
-		return err
+func (s *systemv) servicePath() string {
+	return "/etc/init.d/" + s.c.Name
+}
+
+func (s *systemv) isInstalled() bool {
+	if _, err := os.Stat(s.servicePath()); err != nil {
+		return false
 	}
-	return
+	return true
 }
 
-func (s *systemv) removeLogRoateConf() error {
-	return os.Remove("/etc/logrotate.d/" + s.c.Name)
+func (s *systemv) isRunning() bool {
+	output, err := exec.Command("service", s.c.Name, "status").Output()
+	if err == nil {
+		if matched, err := regexp.MatchString(s.c.Name, string(output)); err == nil && matched {
+			return true
+		}
+	}
+	return false
 }
 
-var logRoateConf = `/var/log/{{.Name}}/{{.Name}}.log {
-	copytruncate
-    daily
-    rotate 10
-    missingok
-    notifempty
-    dateext
-	dateformat %Y%m%d
-    compress
-    delaycompress
-	notifempty
-	nomail
-	noolddir
-}`
+func (s *systemv) configLogFile() error {
+	return prepareLogFile(s.c)
+}
 
 var systemvScript = `#! /bin/sh
 #
-#       /etc/rc.d/init.d/{{.Name}}
+#       /etc/rc.d/init.d/{{commentValue .Name}}
 #
-#       Starts {{.Name}} as a daemon
+#       Starts {{commentValue .Name}} as a daemon
 #
 # chkconfig: 2345 87 17
-# description: {{.Description}}
+# description: {{commentValue .Description}}
 
-{{$deps := "$network $time $named $local_fs"}}
-{{- if .Dependencies}}
-{{$deps = .Dependencies}}
-{{- end}}
 ### BEGIN INIT INFO
-# Provides: {{.Name}}
-# Required-Start: {{$deps}}
-# Required-Stop: {{$deps}}
+# Provides: {{safeName .Name}}
+{{- range lsbDeps .}}
+# {{.Directive}}: {{commentValue .Names}}
+{{- end}}
 # Default-Start: 2 3 4 5
 # Default-Stop: 0 1 6
-# Short-Description: start and stop {{.Name}}.
-# Description: {{.Description}}
+# Short-Description: start and stop {{commentValue .Name}}.
+# Description: {{commentValue .Description}}
 ### END INIT INFO
 
 #
@@ -361,46 +413,68 @@ var systemvScript = `#! /bin/sh
 if [ -f /etc/rc.d/init.d/functions ]; then
     . /etc/rc.d/init.d/functions
 fi
-exec="{{.Exec}}"
-args="{{.Args}}"
-servname="{{.Name}}"
-user="{{.User}}"
-group="{{.Group}}"
-pidfile="{{.PidFile}}"
-lockfile="{{.LockFile}}"
-workingDirectory="{{.WorkDir}}"
-logFile="{{.LogFile}}"
-[ -d $(dirname $lockfile) ] || mkdir -p $(dirname $lockfile)
-[ -e /etc/sysconfig/$servname ] && . /etc/sysconfig/$servname
-
-execPrifx=""
+exec={{shellValue .Exec}}
+servname={{shellValue .Name}}
+user={{shellValue .User}}
+group={{shellValue .Group}}
+pidfile={{shellValue .PidFile}}
+lockfile={{shellValue .LockFile}}
+logFile={{shellValue .LogFile}}
+{{- $stderr := "2>&1"}}
+{{- if .StderrLogFile}}
+errLogFile={{shellValue .StderrLogFile}}
+{{- $stderr = "2>> \"$errLogFile\""}}
+{{- end}}
+# the command is quoted word by word, so the arguments are passed to the service without any expansion
+command={{shellCommand .}}
+[ -d "$(dirname "$lockfile")" ] || mkdir -p "$(dirname "$lockfile")"
+[ -e "/etc/sysconfig/$servname" ] && . "/etc/sysconfig/$servname"
+
+execPrifx="/bin/sh -c"
 userName=` + "`whoami`" + `
 if [ $userName == "root" ]; then
-    execPrifx="su -l $user -c "
-elif [ $userName != $user ]; then
+    # the service accounts usually have a nologin shell
+    execPrifx="su -s /bin/sh -l $user -c"
+elif [ "$userName" != "$user" ]; then
     echo "only run with user root or $user"
     exit 1
 fi
 
 start() {
-    [ -x $exec ] || exit 5
-    if [ -f $pidfile ]; then
-        if ! [ -d "/proc/$(cat $pidfile)" ]; then
-            rm $pidfile
-            if [ -f $lockfile ]; then
-                rm $lockfile
+    [ -x "$exec" ] || exit 5
+    if [ -f "$pidfile" ]; then
+        if ! [ -d "/proc/$(cat "$pidfile")" ]; then
+            rm "$pidfile"
+            if [ -f "$lockfile" ]; then
+                rm "$lockfile"
             fi
         fi
     fi
-    if ! [ -f $pidfile ]; then
+    if ! [ -f "$pidfile" ]; then
         printf "Starting $servname:\t"
-		cd ${workingDirectory}
-        $execPrifx $exec $args &>> $logFile &
-        echo $! > $pidfile
-        touch $lockfile
-        chown -R $user:$group $(dirname $logFile)
-        chown -R $user:$group $(dirname $pidfile)
-        chown -R $user:$group $(dirname $lockfile)
+{{- range dirSettings .}}{{if .Runtime}}
+        [ -d {{shellValue .Path}} ] || { mkdir -p {{shellValue .Path}} && chown "$user:$group" {{shellValue .Path}}; }
+{{- end}}{{end}}
+        # su -l starts in the home directory, so the working directory is changed by the command
+{{- with .Hooks.PreStart}}
+        $execPrifx {{shellHook $ .}} || { failure; echo; exit 1; }
+{{- end}}
+{{- if eq (logKind .LogOutput) "file"}}
+        $execPrifx "$command" >> "$logFile" {{$stderr}} &
+{{- else if eq (logKind .LogOutput) "null"}}
+        $execPrifx "$command" > /dev/null {{$stderr}} &
+{{- else}}
+        # the output is sent to syslog through a fifo, so the pid is still the one of the service
+        logpipe="$(dirname "$pidfile")/$servname.log.fifo"
+        rm -f "$logpipe" && mkfifo -m 600 "$logpipe"
+        logger -t "$servname" -p {{logFacility .LogOutput}}.info < "$logpipe" &
+        $execPrifx "$command" > "$logpipe" {{$stderr}} &
+{{- end}}
+        echo $! > "$pidfile"
+        touch "$lockfile"
+{{- with .Hooks.PostStart}}
+        $execPrifx {{shellHook $ .}}
+{{- end}}
         success
         echo
     else
@@ -412,10 +486,16 @@ start() {
 }
 stop() {
     echo -n $"Stopping $servname: "
-    killproc $servname
+{{- with .Hooks.PreStop}}
+    $execPrifx {{shellHook $ .}}
+{{- end}}
+    killproc "$servname"
     retval=$?
     echo
-    [ $retval -eq 0 ] && rm -f $lockfile
+    [ $retval -eq 0 ] && rm -f "$lockfile"
+{{- with .Hooks.PostStop}}
+    $execPrifx {{shellHook $ .}}
+{{- end}}
     return $retval
 }
 restart() {
@@ -423,7 +503,7 @@ restart() {
     start
 }
 rh_status() {
-    status -p $pidfile $servname
+    status -p "$pidfile" "$servname"
 }
 rh_status_q() {
     rh_status >/dev/null 2>&1
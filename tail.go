@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// tailPollInterval is how often a followed file is checked for new data and rotation
+	tailPollInterval = 250 * time.Millisecond
+
+	// tailChunkSize is the size of the blocks read backwards to find the last lines
+	tailChunkSize = 4096
+)
+
+// tailFile writes the last lines of the file into w, the whole file if lines is zero or nothing if lines is negative,
+// and then keeps writing the appended data until the context is done if follow is true.
+// It handles both kinds of rotation done by logrotate: the file being renamed and a new one created,
+// and the file being truncated in place by copytruncate.
+func tailFile(ctx context.Context, path string, lines int, follow bool, w io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if lines > 0 {
+		offset, err := lastLinesOffset(file, lines)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	} else if lines < 0 {
+		if _, err = file.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	if _, err = io.Copy(w, file); err != nil {
+		return err
+	}
+	if !follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if _, err = io.Copy(w, file); err != nil {
+			return err
+		}
+
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		latest, err := os.Stat(path)
+		if err != nil {
+			// the file has been moved away and the new one hasn't been created yet
+			continue
+		}
+		if !os.SameFile(current, latest) {
+			reopened, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			_ = file.Close()
+			file = reopened
+			continue
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if latest.Size() < offset {
+			// truncated in place, start over from the beginning
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// lastLinesOffset returns the offset of the first of the last n lines in the file
+func lastLinesOffset(file *os.File, n int) (int64, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := fi.Size()
+	buf := make([]byte, tailChunkSize)
+	// a trailing newline terminates the last line and doesn't start a new one
+	skipTrailing := true
+	for end > 0 {
+		size := int64(len(buf))
+		if end < size {
+			size = end
+		}
+		start := end - size
+		if _, err := file.ReadAt(buf[:size], start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		chunk := buf[:size]
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				skipTrailing = false
+				continue
+			}
+			if skipTrailing {
+				skipTrailing = false
+				continue
+			}
+			n--
+			if n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// errNotExecutable appears if the new executable of an upgrade is not an executable regular file
+	errNotExecutable = errors.New("not an executable file")
+
+	// errSameExecutable appears if the new executable of an upgrade is the installed one
+	errSameExecutable = errors.New("the new executable is the installed one")
+
+	// errServiceExited appears if the service stops running while it's watched after an upgrade
+	errServiceExited = errors.New("the service stopped running after the restart")
+
+	// errUpgradeRolledBack appears if the upgraded service didn't become healthy and the previous executable has been restored
+	errUpgradeRolledBack = errors.New("the service didn't become healthy, rolled back to the previous executable")
+)
+
+const (
+	defaultUpgradeWait = 5 * time.Second
+	upgradePollPeriod  = 250 * time.Millisecond
+	selfTestTimeout    = 30 * time.Second
+	selfTestFlag       = "--self-test"
+	prevExecSuffix     = ".prev"
+)
+
+// UpgradeOptions changes how Upgrade checks the new executable
+type UpgradeOptions struct {
+	SelfTest bool          // run the new executable with --self-test first, which must exit with 0
+	Wait     time.Duration // how long the restarted service must keep running, 5s if it's 0
+}
+
+// Upgrader is implemented by the daemons which can replace their executable and roll back if the new one fails,
+// all the built-in backends do. The upgrade restarts a running service, so it doesn't answer between the stop
+// and the start: only the socket of a socket activated systemd service stays open and queues the connections
+// meanwhile, the other services refuse them. A reload can't hand over to another executable.
+type Upgrader interface {
+	Upgrade(newExec string, opts ...UpgradeOptions) error
+}
+
+// upgradeWait returns the longest wait of the options
+func upgradeWait(opts []UpgradeOptions) time.Duration {
+	wait := time.Duration(0)
+	for _, o := range opts {
+		if o.Wait > wait {
+			wait = o.Wait
+		}
+	}
+	if wait == 0 {
+		wait = defaultUpgradeWait
+	}
+	return wait
+}
+
+func selfTestRequested(opts []UpgradeOptions) bool {
+	for _, o := range opts {
+		if o.SelfTest {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeExec replaces the executable of the service with newExec and keeps the previous one as <exec>.prev.
+// A running service is restarted and watched for the wait of the options, then its health check must pass
+// if it has one. The previous executable is restored and restarted if the service isn't healthy by then.
+// A symbolic link to the executable stays, the file it points to is replaced with the same owner and mode.
+func upgradeExec(c *config, newExec string, opts []UpgradeOptions, running func() bool, restart func() error) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("failed to upgrade: %w", err)
+		}
+	}()
+	current, err := executablePath(c.Exec)
+	if err != nil {
+		return err
+	}
+	if current, err = filepath.EvalSymlinks(current); err != nil {
+		return err
+	}
+	currentInfo, err := os.Stat(current)
+	if err != nil {
+		return err
+	}
+	if newExec, err = filepath.Abs(newExec); err != nil {
+		return err
+	}
+	fi, err := os.Stat(newExec)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(fi, currentInfo) {
+		return errSameExecutable
+	}
+	if !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s: %w", newExec, errNotExecutable)
+	}
+	if selfTestRequested(opts) {
+		if err = selfTest(newExec); err != nil {
+			return err
+		}
+	}
+
+	wasRunning := running()
+	prev := current + prevExecSuffix
+	if err = keepPrevious(current, prev, currentInfo); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(newExec)
+	if err != nil {
+		return err
+	}
+	if err = replaceFile(current, content, currentInfo); err != nil {
+		return err
+	}
+	// a stopped service runs the new executable on its next start
+	if !wasRunning {
+		return nil
+	}
+
+	if err = restart(); err == nil {
+		err = waitHealthy(upgradeWait(opts), running)
+	}
+	// a running service must pass its health check as well
+	if err == nil && c.HealthCheck != nil {
+		err = waitHealthCheck(context.Background(), c)
+	}
+	if err == nil {
+		return nil
+	}
+	if rerr := os.Rename(prev, current); rerr != nil {
+		return fmt.Errorf("%v, and failed to roll back: %w", err, rerr)
+	}
+	if rerr := restart(); rerr != nil {
+		return fmt.Errorf("%v, and failed to restart the previous executable: %w", err, rerr)
+	}
+	return fmt.Errorf("%v: %w", err, errUpgradeRolledBack)
+}
+
+// selfTest runs the executable with --self-test
+func selfTest(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, path, selfTestFlag).CombinedOutput(); err != nil {
+		return fmt.Errorf("self test of %s failed: %w: %s", path, err, out)
+	}
+	return nil
+}
+
+// keepPrevious links the current executable as prev, the link keeps the file even if it's replaced
+func keepPrevious(current, prev string, fi os.FileInfo) error {
+	if err := checkSymlinks(prev); err != nil {
+		return err
+	}
+	if err := os.Remove(prev); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(current, prev); err == nil {
+		return nil
+	}
+	// a file system without hard links
+	content, err := os.ReadFile(current)
+	if err != nil {
+		return err
+	}
+	return replaceFile(prev, content, fi)
+}
+
+// waitHealthy fails as soon as the service stops running during the wait
+func waitHealthy(wait time.Duration, running func() bool) error {
+	deadline := time.Now().Add(wait)
+	for {
+		if !running() {
+			return errServiceExited
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(upgradePollPeriod)
+	}
+}
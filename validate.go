@@ -0,0 +1,286 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// errInvalidName appears if the name can't be used as a service or file name
+	errInvalidName = errors.New("only letters, digits and . _ @ : - are allowed")
+
+	// errRelativePath appears if a path which must be absolute is relative
+	errRelativePath = errors.New("must be an absolute path")
+
+	// errNoSuchUser appears if the user doesn't exist on the system
+	errNoSuchUser = errors.New("no such user")
+
+	// errNoSuchGroup appears if the group doesn't exist on the system
+	errNoSuchGroup = errors.New("no such group")
+
+	// errNotDirectory appears if a path which must be an existing directory isn't
+	errNotDirectory = errors.New("not an existing directory")
+
+	// errNotWritable appears if the directory which the service writes into is not writable
+	errNotWritable = errors.New("directory is not writable")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_.@:-]+$`)
+
+// validDependency matches a systemd unit or an LSB facility such as $network
+var validDependency = regexp.MustCompile(`^\$?[A-Za-z0-9_.@:\\-]+$`)
+
+// FieldError describes an invalid value of a config field
+type FieldError struct {
+	Field string // the field name, e.g. "Exec" for the value set by WithExec
+	Value string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError contains all the invalid fields found by Validate
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// Validate applies the options in the same way as New and checks the resulting config,
+// the returned error is a ValidationError if any field is invalid.
+// New only checks the values which can't be written into the service files, Validate checks
+// the host as well: the user and the group must exist, WorkDir must exist and the log directories
+// must be writable by the user.
+func Validate(options ...Configurator) error {
+	conf := defaultConfig()
+	for _, op := range options {
+		if err := op.apply(conf); err != nil {
+			return err
+		}
+	}
+	if err := setupConfig(conf); err != nil {
+		return err
+	}
+	return conf.validate(true)
+}
+
+// validate checks the syntax of the values, and the accounts and the directories on the host if host is true
+func (c *config) validate(host bool) error {
+	var errs ValidationError
+	check := func(field, value string, err error) {
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field, Value: value, Err: err})
+		}
+	}
+
+	// a newline in any value would add a directive to the service files
+	for _, f := range []struct{ field, value string }{
+		{"Description", c.Description},
+		{"Exec", c.Exec},
+		{"Args", c.Args},
+		{"WorkDir", c.WorkDir},
+		{"Dependencies", c.Dependencies},
+		{"User", c.User},
+		{"Group", c.Group},
+		{"LogFile", c.LogFile},
+		{"StderrLogFile", c.StderrLogFile},
+		{"PidFile", c.PidFile},
+		{"LockFile", c.LockFile},
+	} {
+		check(f.field, f.value, checkControl(f.value))
+	}
+	if _, err := splitArgs(c.Args); err != nil {
+		check("Args", c.Args, err)
+	}
+	for _, dep := range strings.Fields(c.Dependencies) {
+		if !validDependency.MatchString(dep) {
+			check("Dependencies", dep, errInvalidName)
+		}
+	}
+	for _, d := range c.Deps {
+		check("Deps", d.Name+" "+string(d.Kind), validateDep(d))
+	}
+	if c.Schedule != nil {
+		check("Schedule", fmt.Sprintf("%+v", *c.Schedule), validateSchedule(c.Schedule))
+		if c.Instances {
+			check("Schedule", fmt.Sprintf("%+v", *c.Schedule), errScheduleUnsupported)
+		}
+	}
+	for _, l := range c.Sockets {
+		check("Sockets", string(l.Type)+" "+l.Address, validateListen(l))
+	}
+	// a socket starts a long-running service, and one socket can't be shared by the instances
+	if len(c.Sockets) > 0 && (c.Schedule != nil || c.Instances) {
+		check("Sockets", c.Sockets[0].Address, errSocketUnsupported)
+	}
+	if c.HealthCheck != nil {
+		check("HealthCheck", c.HealthCheck.Probe.String(), validateProbe(c.HealthCheck.Probe))
+	}
+	for _, h := range []struct{ field, line string }{
+		{"Hooks.PreStart", c.Hooks.PreStart},
+		{"Hooks.PostStart", c.Hooks.PostStart},
+		{"Hooks.PreStop", c.Hooks.PreStop},
+		{"Hooks.PostStop", c.Hooks.PostStop},
+	} {
+		if h.line != "" {
+			check(h.field, h.line, validateHook(h.line))
+		}
+	}
+	if c.SupervisorServer != "" {
+		check("SupervisorServer", redactPassword(c.SupervisorServer), validateSupervisorServer(c.SupervisorServer))
+	}
+	if c.LogOutput.kind == syslogOutput && !validName.MatchString(c.LogOutput.facility) {
+		check("LogOutput", c.LogOutput.String(), errInvalidName)
+	}
+	if !validName.MatchString(c.Name) {
+		check("Name", c.Name, errInvalidName)
+	} else if c.Instances && strings.Contains(c.Name, "@") {
+		// the instance name follows the @
+		check("Name", c.Name, errInvalidName)
+	}
+	if !filepath.IsAbs(c.Exec) {
+		check("Exec", c.Exec, errRelativePath)
+	}
+	if !filepath.IsAbs(c.WorkDir) {
+		check("WorkDir", c.WorkDir, errRelativePath)
+	} else if host {
+		check("WorkDir", c.WorkDir, validateDir(c.WorkDir))
+	}
+	// the missing accounts are created by Install if WithCreateUser is used
+	if c.CreateUser == nil && host {
+		if _, err := user.Lookup(c.User); err != nil {
+			check("User", c.User, errNoSuchUser)
+		}
+		if _, err := user.LookupGroup(c.Group); err != nil {
+			check("Group", c.Group, errNoSuchGroup)
+		}
+	} else if c.CreateUser != nil {
+		if !validName.MatchString(c.User) {
+			check("User", c.User, errInvalidName)
+		}
+		if !validName.MatchString(c.Group) {
+			check("Group", c.Group, errInvalidName)
+		}
+	}
+	for _, f := range []struct{ field, path string }{
+		{"LogFile", c.LogFile},
+		{"PidFile", c.PidFile},
+		{"LockFile", c.LockFile},
+		{"StderrLogFile", c.StderrLogFile},
+	} {
+		if f.path != "" && !filepath.IsAbs(f.path) {
+			check(f.field, f.path, errRelativePath)
+		}
+	}
+	var rotationErr *FieldError
+	if errors.As(validateRotation(c.Rotation), &rotationErr) {
+		errs = append(errs, rotationErr)
+	}
+	for _, d := range c.managedDirs() {
+		check("Directories."+d.field, d.name, validateManagedDir(d.name))
+	}
+	// the account doesn't exist yet if it's created by Install, and a dynamic one only exists while the service runs
+	if c.CreateUser == nil && host {
+		for _, f := range []struct{ field, path string }{
+			{"LogFile", c.LogFile},
+			{"StderrLogFile", c.StderrLogFile},
+		} {
+			if filepath.IsAbs(f.path) {
+				check(f.field, f.path, validateWritableDir(filepath.Dir(f.path), c.User, c.Group))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return errRelativePath
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return errNotDirectory
+	}
+	return nil
+}
+
+// validateWritableDir checks by the owner, the group and the mode of dir that the service's user can write into it.
+// A missing directory is created by Install and given to the user, so only its nearest existing parent
+// has to be a directory.
+func validateWritableDir(dir, userName, groupName string) error {
+	fi, err := os.Stat(dir)
+	for os.IsNotExist(err) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+		if fi, err = os.Stat(dir); err == nil {
+			if !fi.IsDir() {
+				return errNotDirectory
+			}
+			return nil
+		}
+	}
+	if err != nil || !fi.IsDir() {
+		return errNotDirectory
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		return nil
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		// a missing user is reported by the check of User
+		return nil
+	}
+	mode := fi.Mode().Perm()
+	switch {
+	case u.Uid == "0":
+		return nil
+	case u.Uid == strconv.FormatUint(uint64(uid), 10):
+		if mode&0200 != 0 {
+			return nil
+		}
+	case inGroup(u, groupName, strconv.FormatUint(uint64(gid), 10)):
+		if mode&0020 != 0 {
+			return nil
+		}
+	case mode&0002 != 0:
+		return nil
+	}
+	return errNotWritable
+}
+
+// inGroup reports whether the gid is the service's group or one of the groups of the user
+func inGroup(u *user.User, groupName, gid string) bool {
+	if g, err := user.LookupGroup(groupName); err == nil && g.Gid == gid {
+		return true
+	}
+	gids, _ := u.GroupIds()
+	for _, id := range gids {
+		if id == gid {
+			return true
+		}
+	}
+	return false
+}
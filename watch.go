@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errWatchUnsupported appears if a job run by cron is watched, cron doesn't track the jobs it runs
+	errWatchUnsupported = errors.New("the state of a job run by cron can't be watched")
+
+	// errNoEventListener appears if a supervisord program is watched which was installed without the event listener
+	errNoEventListener = errors.New("the program has no event listener, install it again to watch it")
+)
+
+// watchInterval is how often the state is polled by the backends which don't push the changes
+const watchInterval = time.Second
+
+// State is a state of the service reported by Watch
+type State string
+
+const (
+	Starting   State = "starting"
+	Running    State = "running"
+	Exited     State = "exited"     // the process exited by itself, see StateEvent.ExitCode
+	Restarting State = "restarting" // the process manager starts the process again after it exited
+	Stopped    State = "stopped"
+)
+
+// StateEvent is a transition of the service to a new state
+type StateEvent struct {
+	Time     time.Time
+	Unit     string // the name of the service
+	State    State
+	ExitCode int // the exit status of an Exited or Restarting event, -1 if it's unknown or the process was killed
+}
+
+// Watcher is implemented by the daemons which can report the state changes of the service,
+// all the built-in backends do though cron jobs return an error. The channel is closed once ctx is done.
+type Watcher interface {
+	Watch(ctx context.Context) (<-chan StateEvent, error)
+}
+
+// stateSample is the state of the service found by a poll
+type stateSample struct {
+	state    State
+	exitCode int
+}
+
+// pollStates polls the state of the service every watchInterval and sends the transitions until ctx is done.
+// The first state is only the starting point. A process which restarts has exited, so an Exited event
+// is sent before Restarting if the exit was missed between two polls.
+func pollStates(ctx context.Context, unit string, poll func() (stateSample, error)) (<-chan StateEvent, error) {
+	last, err := poll()
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan StateEvent)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := poll()
+			if err != nil || current == last {
+				continue
+			}
+			var changes []stateSample
+			if current.state == Restarting && last.state != Exited {
+				changes = append(changes, stateSample{Exited, current.exitCode})
+			}
+			changes = append(changes, current)
+			for _, change := range changes {
+				event := StateEvent{Time: time.Now(), Unit: unit, State: change.state, ExitCode: change.exitCode}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			last = current
+		}
+	}()
+	return events, nil
+}
+
+// pidFileState finds the state of a service started by an init script from its pid file,
+// a process which is gone while the lock file is still there has exited without being stopped
+func pidFileState(pidFile, lockFile string) (stateSample, error) {
+	data, err := os.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return stateSample{Stopped, -1}, nil
+	}
+	if err != nil {
+		return stateSample{}, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && pid > 0 && pathOrFileIsExist("/proc/"+strconv.Itoa(pid)) {
+		return stateSample{Running, -1}, nil
+	}
+	if pathOrFileIsExist(lockFile) {
+		return stateSample{Exited, -1}, nil
+	}
+	return stateSample{Stopped, -1}, nil
+}
+
+// supervisordEventsLog is where supervisord writes the events of the program reported by its event listener
+func supervisordEventsLog(name string) string {
+	return "/var/log/supervisor/" + name + ".events.log"
+}
+
+// supervisordEvents follows the events log of the program and turns the process state events into StateEvent.
+// The listener gets no exit status from supervisord, an expected exit is a zero status because exitcodes=0.
+func supervisordEvents(ctx context.Context, name string) (<-chan StateEvent, error) {
+	path := supervisordEventsLog(name)
+	if !pathOrFileIsExist(path) {
+		return nil, errNoEventListener
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(tailFile(ctx, path, -1, true, pw))
+	}()
+
+	events := make(chan StateEvent)
+	go func() {
+		defer close(events)
+		defer func() {
+			_ = pr.Close()
+		}()
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			event, ok := parseSupervisordEvent(scanner.Text(), name)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// parseSupervisordEvent parses a line such as "event PROCESS_STATE_EXITED processname:name groupname:name
+// from_state:RUNNING expected:0 pid:42" written by the event listener, the other lines are the output of the hooks
+func parseSupervisordEvent(line, name string) (StateEvent, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "event" {
+		return StateEvent{}, false
+	}
+	event := StateEvent{Time: time.Now(), Unit: name, ExitCode: -1}
+	switch fields[1] {
+	case "PROCESS_STATE_STARTING":
+		event.State = Starting
+	case "PROCESS_STATE_RUNNING":
+		event.State = Running
+	case "PROCESS_STATE_BACKOFF":
+		// the process exited before it was considered running and is started again
+		event.State = Restarting
+	case "PROCESS_STATE_EXITED", "PROCESS_STATE_FATAL":
+		event.State = Exited
+		for _, field := range fields[2:] {
+			if field == "expected:1" {
+				event.ExitCode = 0
+			}
+		}
+	case "PROCESS_STATE_STOPPED":
+		event.State = Stopped
+	default:
+		return StateEvent{}, false
+	}
+	return event, true
+}
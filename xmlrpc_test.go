@@ -0,0 +1,523 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSupervisor answers the XML-RPC calls like supervisord, the handler of a method returns the result
+// or a *rpcFault
+type fakeSupervisor struct {
+	url      string
+	mu       sync.Mutex
+	calls    []string
+	log      string
+	handlers map[string]func(args []interface{}) interface{}
+}
+
+type rpcCall struct {
+	Method string     `xml:"methodName"`
+	Params []rpcValue `xml:"params>param>value"`
+}
+
+func (f *fakeSupervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/RPC2" {
+		http.NotFound(w, r)
+		return
+	}
+	var call rpcCall
+	if err := xml.NewDecoder(r.Body).Decode(&call); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args := make([]interface{}, 0, len(call.Params))
+	for _, p := range call.Params {
+		args = append(args, p.decode())
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, strings.TrimSpace(call.Method+" "+strings.TrimSuffix(fmt.Sprintln(args...), "\n")))
+	handler, ok := f.handlers[call.Method]
+	f.mu.Unlock()
+	var result interface{} = &rpcFault{Code: 1, Message: "UNKNOWN_METHOD"}
+	if ok {
+		result = handler(args)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + "<methodResponse>")
+	if fault, ok := result.(*rpcFault); ok {
+		buf.WriteString("<fault><value>")
+		writeValue(&buf, map[string]interface{}{"faultCode": fault.Code, "faultString": fault.Message})
+		buf.WriteString("</value></fault>")
+	} else {
+		buf.WriteString("<params><param><value>")
+		writeValue(&buf, result)
+		buf.WriteString("</value></param></params>")
+	}
+	buf.WriteString("</methodResponse>")
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeValue encodes the value like supervisord, the strings have no type element
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		buf.WriteString("<int>" + strconv.Itoa(v) + "</int>")
+	case bool:
+		if v {
+			buf.WriteString("<boolean>1</boolean>")
+		} else {
+			buf.WriteString("<boolean>0</boolean>")
+		}
+	case string:
+		_ = xml.EscapeText(buf, []byte(v))
+	case []string:
+		values := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			values = append(values, s)
+		}
+		writeValue(buf, values)
+	case []interface{}:
+		buf.WriteString("<array><data>")
+		for _, item := range v {
+			buf.WriteString("<value>")
+			writeValue(buf, item)
+			buf.WriteString("</value>")
+		}
+		buf.WriteString("</data></array>")
+	case map[string]interface{}:
+		buf.WriteString("<struct>")
+		for name, item := range v {
+			buf.WriteString("<member><name>" + name + "</name><value>")
+			writeValue(buf, item)
+			buf.WriteString("</value></member>")
+		}
+		buf.WriteString("</struct>")
+	}
+}
+
+func (f *fakeSupervisor) handle(method string, handler func(args []interface{}) interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handlers == nil {
+		f.handlers = make(map[string]func(args []interface{}) interface{})
+	}
+	f.handlers[method] = handler
+}
+
+func (f *fakeSupervisor) takeCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func (f *fakeSupervisor) setLog(log string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = log
+}
+
+// serveLog answers tailProcessStdoutLog and readProcessStdoutLog from the log like supervisord's tailFile and readFile
+func (f *fakeSupervisor) serveLog() {
+	f.handle("supervisor.tailProcessStdoutLog", func(args []interface{}) interface{} {
+		offset, _ := args[1].(int)
+		length, _ := args[2].(int)
+		f.mu.Lock()
+		log := f.log
+		f.mu.Unlock()
+		size := len(log)
+		overflow := false
+		if size > offset+length {
+			overflow = true
+			offset = size - 1
+		}
+		if offset+length > size {
+			if offset > size-1 {
+				length = 0
+			}
+			offset = size - length
+		}
+		if offset < 0 {
+			offset = 0
+		}
+		end := offset + length
+		if end > size {
+			end = size
+		}
+		return []interface{}{log[offset:end], size, overflow}
+	})
+	f.handle("supervisor.readProcessStdoutLog", func(args []interface{}) interface{} {
+		offset, _ := args[1].(int)
+		length, _ := args[2].(int)
+		f.mu.Lock()
+		log := f.log
+		f.mu.Unlock()
+		if offset > len(log) {
+			return &rpcFault{Code: 2, Message: "BAD_ARGUMENTS"}
+		}
+		if offset+length > len(log) {
+			length = len(log) - offset
+		}
+		return log[offset : offset+length]
+	})
+}
+
+func newFakeSupervisor(t *testing.T) (*fakeSupervisor, *supervisorClient) {
+	t.Helper()
+	fake := &fakeSupervisor{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+	client := newSupervisorClient(server.URL)
+	if client == nil {
+		t.Fatalf("no client of %s", server.URL)
+	}
+	return fake, client
+}
+
+func TestSupervisorProcessInfo(t *testing.T) {
+	fake, client := newFakeSupervisor(t)
+	fake.handle("supervisor.getProcessInfo", func(args []interface{}) interface{} {
+		if args[0] != "svc" {
+			return &rpcFault{Code: faultBadName, Message: "BAD_NAME"}
+		}
+		return map[string]interface{}{"name": "svc", "statename": "RUNNING", "pid": 42, "exitstatus": 0}
+	})
+
+	info, err := client.processInfo(context.Background(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (processInfo{StateName: "RUNNING", PID: 42}); info != want {
+		t.Errorf("processInfo = %+v, want %+v", info, want)
+	}
+
+	_, err = client.processInfo(context.Background(), "other")
+	if !isFault(err, faultBadName) || isUnreachable(err) {
+		t.Errorf("processInfo of an unknown process = %v, want the BAD_NAME fault", err)
+	}
+}
+
+func TestSupervisorFaults(t *testing.T) {
+	fake, client := newFakeSupervisor(t)
+	fake.handle("supervisor.startProcess", func(args []interface{}) interface{} {
+		if args[1] != true {
+			t.Errorf("startProcess(%v) doesn't wait", args)
+		}
+		return &rpcFault{Code: faultAlreadyStarted, Message: "ALREADY_STARTED: svc"}
+	})
+	fake.handle("supervisor.stopProcess", func(args []interface{}) interface{} {
+		return &rpcFault{Code: faultNotRunning, Message: "NOT_RUNNING: svc"}
+	})
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		op   func() error
+		code int
+	}{
+		{func() error { return client.startProcess(ctx, "svc") }, faultAlreadyStarted},
+		{func() error { return client.stopProcess(ctx, "svc") }, faultNotRunning},
+	} {
+		err := tt.op()
+		if !isFault(err, tt.code) {
+			t.Errorf("got %v, want the fault %d", err, tt.code)
+		}
+		if isUnreachable(err) {
+			t.Errorf("the fault %v is taken for an unreachable server", err)
+		}
+	}
+	if calls := fake.takeCalls(); !reflect.DeepEqual(calls, []string{
+		"supervisor.startProcess svc true",
+		"supervisor.stopProcess svc true",
+	}) {
+		t.Errorf("calls = %q", calls)
+	}
+
+	// a fault is the answer of supervisord, supervisorctl isn't run instead
+	err := supervisorCall(fake.url, func(ctx context.Context, c *supervisorClient) error {
+		return c.stopProcess(ctx, "svc")
+	}, []string{"stop", "svc"})
+	if !isFault(err, faultNotRunning) {
+		t.Errorf("supervisorCall = %v, want the NOT_RUNNING fault", err)
+	}
+}
+
+func TestSupervisorUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	client := newSupervisorClient(url)
+	_, err := client.processInfo(context.Background(), "svc")
+	if err == nil || !isUnreachable(err) {
+		t.Fatalf("processInfo of a closed server = %v, want an unreachable error", err)
+	}
+	_, err = newSupervisorClient("unix://"+filepath.Join(t.TempDir(), "missing.sock")).processInfo(context.Background(), "svc")
+	if err == nil || !isUnreachable(err) {
+		t.Fatalf("processInfo of a missing socket = %v, want an unreachable error", err)
+	}
+
+	if _, lookErr := exec.LookPath("supervisorctl"); lookErr == nil {
+		t.Skip("supervisorctl would be run against the closed server")
+	}
+	err = supervisorCall(url, func(ctx context.Context, c *supervisorClient) error {
+		_, err := c.processInfo(ctx, "svc")
+		return err
+	}, []string{"status", "svc"})
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("supervisorCall of a closed server = %v, want supervisorctl to be run", err)
+	}
+}
+
+func TestSupervisorTimeoutAnswered(t *testing.T) {
+	fake, client := newFakeSupervisor(t)
+	release := make(chan struct{})
+	defer close(release)
+	fake.handle("supervisor.startProcess", func(args []interface{}) interface{} {
+		<-release
+		return true
+	})
+
+	// supervisord got the call and may still start the process, supervisorctl mustn't start it again
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client.startProcess(ctx, "svc")
+	if !errors.Is(err, context.DeadlineExceeded) || isUnreachable(err) {
+		t.Errorf("startProcess after the deadline = %v, want an answered timeout", err)
+	}
+}
+
+func TestSupervisorUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "supervisor.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	fake := &fakeSupervisor{}
+	fake.handle("supervisor.getProcessInfo", func(args []interface{}) interface{} {
+		return map[string]interface{}{"statename": "STOPPED", "pid": 0, "exitstatus": 1}
+	})
+	server := &http.Server{Handler: fake}
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	client := newSupervisorClient("unix://" + sock)
+	info, err := client.processInfo(context.Background(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (processInfo{StateName: "STOPPED", ExitStatus: 1}); info != want {
+		t.Errorf("processInfo = %+v, want %+v", info, want)
+	}
+}
+
+func TestSupervisorBasicAuth(t *testing.T) {
+	fake := &fakeSupervisor{}
+	fake.handle("supervisor.getProcessInfo", func(args []interface{}) interface{} {
+		return map[string]interface{}{"statename": "RUNNING", "pid": 7}
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	authorized := strings.Replace(server.URL, "http://", "http://admin:secret@", 1)
+	if _, err := newSupervisorClient(authorized).processInfo(context.Background(), "svc"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := newSupervisorClient(server.URL).processInfo(context.Background(), "svc")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("processInfo without the password = %v, want 401", err)
+	}
+}
+
+func TestSupervisorUpdate(t *testing.T) {
+	fake, client := newFakeSupervisor(t)
+	fake.handle("supervisor.reloadConfig", func(args []interface{}) interface{} {
+		return []interface{}{[]interface{}{[]string{"new"}, []string{"changed"}, []string{"gone"}}}
+	})
+	fake.handle("supervisor.stopProcessGroup", func(args []interface{}) interface{} {
+		if args[0] == "changed" {
+			return &rpcFault{Code: faultNotRunning, Message: "NOT_RUNNING: changed"}
+		}
+		return []interface{}{}
+	})
+	fake.handle("supervisor.removeProcessGroup", func(args []interface{}) interface{} {
+		if args[0] == "gone" {
+			// removed by someone else meanwhile
+			return &rpcFault{Code: faultBadName, Message: "BAD_NAME: gone"}
+		}
+		return true
+	})
+	fake.handle("supervisor.addProcessGroup", func(args []interface{}) interface{} {
+		if args[0] == "new" {
+			return &rpcFault{Code: faultAlreadyAdded, Message: "ALREADY_ADDED: new"}
+		}
+		return true
+	})
+
+	added, changed, removed, err := client.reloadConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([][]string{added, changed, removed}, [][]string{{"new"}, {"changed"}, {"gone"}}) {
+		t.Errorf("reloadConfig = %q, %q, %q", added, changed, removed)
+	}
+	fake.takeCalls()
+
+	if err = client.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"supervisor.reloadConfig",
+		"supervisor.stopProcessGroup gone true",
+		"supervisor.removeProcessGroup gone",
+		"supervisor.stopProcessGroup changed true",
+		"supervisor.removeProcessGroup changed",
+		"supervisor.addProcessGroup changed",
+		"supervisor.addProcessGroup new",
+	}
+	if calls := fake.takeCalls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("update calls\n%q\nwant\n%q", calls, want)
+	}
+
+	// any other fault stops the update
+	fake.handle("supervisor.addProcessGroup", func(args []interface{}) interface{} {
+		return &rpcFault{Code: 2, Message: "BAD_ARGUMENTS"}
+	})
+	if err = client.update(context.Background()); !isFault(err, 2) {
+		t.Errorf("update = %v, want the BAD_ARGUMENTS fault", err)
+	}
+
+	fake.handle("supervisor.reloadConfig", func(args []interface{}) interface{} {
+		return []interface{}{"unexpected"}
+	})
+	if err = client.update(context.Background()); !errors.Is(err, errUnexpectedResponse) {
+		t.Errorf("update of a malformed reloadConfig = %v, want %v", err, errUnexpectedResponse)
+	}
+}
+
+// syncBuffer is written by the follow loop and read by the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor waits until the buffer has the content
+func waitFor(t *testing.T, b *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * tailPollInterval)
+	for b.String() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, want %q", b.String(), want)
+		}
+		time.Sleep(tailPollInterval / 5)
+	}
+}
+
+func TestSupervisorTailLog(t *testing.T) {
+	fake, client := newFakeSupervisor(t)
+	fake.serveLog()
+	fake.setLog("one\ntwo\nthree\n")
+
+	data, size, err := client.tailLog(context.Background(), "svc", "stdout", 0, 6)
+	if err != nil || data != "three\n" || size != 14 {
+		t.Errorf("tailLog = %q, %d, %v, want the last 6 bytes and the size 14", data, size, err)
+	}
+	data, size, err = client.tailLog(context.Background(), "svc", "stdout", 0, 0)
+	if err != nil || data != "" || size != 14 {
+		t.Errorf("tailLog of nothing = %q, %d, %v, want the size 14", data, size, err)
+	}
+	data, err = client.readLog(context.Background(), "svc", "stdout", 4, 4)
+	if err != nil || data != "two\n" {
+		t.Errorf("readLog = %q, %v, want %q", data, err, "two\n")
+	}
+}
+
+func TestSupervisorFollowLog(t *testing.T) {
+	fake, client := newFakeSupervisor(t)
+	fake.serveLog()
+	fake.setLog("one\ntwo\n")
+
+	s := &supervisord{c: &config{Name: "svc"}}
+	out := &syncBuffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.rpcLogs(ctx, client, LogOptions{Follow: true, Lines: 1, Writer: out}, "stdout")
+	}()
+
+	waitFor(t, out, "two\n")
+	fake.setLog("one\ntwo\nthree\n")
+	waitFor(t, out, "two\nthree\n")
+	// rotated by copytruncate, the new log is shorter than the offset
+	fake.setLog("four\n")
+	waitFor(t, out, "two\nthree\nfour\n")
+	fake.setLog("four\nfive\n")
+	waitFor(t, out, "two\nthree\nfour\nfive\n")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("rpcLogs = %v, want nil once the context is done", err)
+		}
+	case <-time.After(10 * tailPollInterval):
+		t.Fatal("rpcLogs didn't return once the context is done")
+	}
+}
+
+func TestSupervisorCallAnswered(t *testing.T) {
+	fake, _ := newFakeSupervisor(t)
+	fake.handle("supervisor.stopProcess", func(args []interface{}) interface{} {
+		return &rpcFault{Code: faultNotRunning, Message: "NOT_RUNNING: svc"}
+	})
+
+	// the error made of a fault is an answer as well, supervisorctl isn't run to stop it again
+	err := supervisorCall(fake.url, func(ctx context.Context, c *supervisorClient) error {
+		if err := c.stopProcess(ctx, "svc"); isFault(err, faultNotRunning) {
+			return errAlreadyStopped
+		}
+		return nil
+	}, []string{"stop", "svc"})
+	if !errors.Is(err, errAlreadyStopped) {
+		t.Errorf("supervisorCall = %v, want %v", err, errAlreadyStopped)
+	}
+	if isUnreachable(errAlreadyRunning) || isUnreachable(errUnexpectedResponse) {
+		t.Error("the errors made of an answer are taken for an unreachable server")
+	}
+}